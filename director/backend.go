@@ -0,0 +1,39 @@
+package director
+
+// keyEvent is a change to a single key: a new value, or the removal of the
+// key and every key under it.
+type keyEvent struct {
+	key, value string
+	deleted    bool
+}
+
+// keyUpdate is a single response of a watch: the changes made at an index of
+// the store. An update without any events reports the watch's progress.
+type keyUpdate struct {
+	index  uint64
+	events []keyEvent
+}
+
+// keyBackend reads and watches keys in a store, such as etcd. Backends only
+// talk to the store: EtcdCluster applies what they read to its directors,
+// and handles batching, backoff and confirmation for every backend alike.
+type keyBackend interface {
+
+	// fetch reads every key under the prefix key, returning them with the
+	// index they were read at. A missing prefix key has no keys under it.
+	fetch(prefix string) (map[string]string, uint64, error)
+
+	// watch sends the updates of keys under the prefix key, starting after
+	// the index, until the watch fails or the stop channel is closed.
+	watch(prefix string, index uint64, updates chan<- *keyUpdate, stop <-chan struct{}) error
+
+	// probe checks that the store can be reached.
+	probe(prefix string) error
+
+	// put sets the value of a key.
+	put(key, value string) error
+
+	// resync reports whether or not a watch error means the watch fell
+	// behind the history kept by the store, so the keys must be read again.
+	resync(err error) bool
+}
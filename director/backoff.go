@@ -0,0 +1,32 @@
+package director
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes capped exponential delays with jitter, so that many
+// instances retrying against the same server spread their attempts out.
+type backoff struct {
+	min, max time.Duration
+	attempt  uint
+}
+
+// next returns the delay before the next attempt. Each delay is picked at
+// random from the upper half of an interval that doubles with every attempt,
+// up to the maximum.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		d = b.min << b.attempt
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// reset starts the delays over from the minimum.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
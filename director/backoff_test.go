@@ -0,0 +1,23 @@
+package director
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+
+	limits := []time.Duration{1, 2, 4, 8, 10, 10}
+	for _, limit := range limits {
+		limit *= time.Second
+		if d := b.next(); d < limit/2 || d > limit {
+			t.Errorf("expected a delay between %s and %s, got %s", limit/2, limit, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Errorf("expected the delay to start over, got %s", d)
+	}
+}
@@ -0,0 +1,333 @@
+package director
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tableSource is implemented by directors that publish routing tables, so a
+// composite director can merge them.
+type tableSource interface {
+	routingTable() *table
+}
+
+// routingTable returns the published routing table.
+func (k *keyState) routingTable() *table {
+	return k.table.Load()
+}
+
+// mergedTable is a merged routing table along with the source tables it was
+// built from.
+type mergedTable struct {
+	sources []*table
+	table   *table
+}
+
+// compositeDirector layers the configuration of several directors, with
+// later sources taking precedence:
+//
+//   - Domain prefixes are merged prefix by prefix. A prefix defined by
+//     several sources routes to the service of the last one.
+//   - Service settings are merged setting by setting, the last source
+//     defining a setting giving its value.
+//   - Service addresses are replaced as a whole. The last source defining
+//     any address of a service gives all of its addresses, so an override
+//     can drop an address by leaving it out. Sources that only define
+//     settings of a service keep the addresses of earlier ones.
+//
+// For example, a routing file can define every route and service setting,
+// an etcd prefix override some of them, and Consul provide the current
+// addresses of services.
+//
+// Directors that don't publish routing tables can't be merged. They're
+// consulted directly when the merged table can't route a request, from the
+// last to the first.
+type compositeDirector struct {
+	sources []Director
+
+	// merged is rebuilt, while holding the lock, whenever a source has
+	// published a new table since it was last built.
+	merged atomic.Pointer[mergedTable]
+	lock   sync.Mutex
+
+	// conflicts holds the conflicts found by the last merge, so only new
+	// ones are logged.
+	conflicts map[string]bool
+}
+
+// NewCompositeDirector returns a director merging the sources, with later
+// sources taking precedence over earlier ones.
+func NewCompositeDirector(sources ...Director) *compositeDirector {
+	c := &compositeDirector{
+		sources:   sources,
+		conflicts: make(map[string]bool),
+	}
+
+	c.merged.Store(&mergedTable{table: newTable()})
+	return c
+}
+
+// sourceTables returns the current table of every source that publishes
+// them, in order.
+func (c *compositeDirector) sourceTables() []*table {
+	var tables []*table
+	for _, source := range c.sources {
+		if ts, ok := source.(tableSource); ok {
+			tables = append(tables, ts.routingTable())
+		}
+	}
+	return tables
+}
+
+// current returns the merged table, rebuilding it if any source has
+// published a new table.
+func (c *compositeDirector) current() *table {
+	if merged := c.merged.Load(); !c.changed(merged.sources) {
+		return merged.table
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Another pick may have rebuilt the table in the meantime.
+	previous := c.merged.Load()
+	if !c.changed(previous.sources) {
+		return previous.table
+	}
+
+	tables := c.sourceTables()
+	merged, conflicts := mergeTables(tables, previous.table)
+	c.merged.Store(&mergedTable{sources: tables, table: merged})
+
+	// Log conflicts as they appear.
+	current := make(map[string]bool, len(conflicts))
+	for _, conflict := range conflicts {
+		current[conflict] = true
+		if !c.conflicts[conflict] {
+			log.Warn(conflict)
+		}
+	}
+	c.conflicts = current
+
+	return merged
+}
+
+// changed reports whether or not the current tables of the sources differ
+// from the tables, in order. It's called on every pick, so unlike
+// sourceTables it doesn't allocate.
+func (c *compositeDirector) changed(tables []*table) bool {
+	i := 0
+	for _, source := range c.sources {
+		if ts, ok := source.(tableSource); ok {
+			if i >= len(tables) || tables[i] != ts.routingTable() {
+				return true
+			}
+			i++
+		}
+	}
+	return i != len(tables)
+}
+
+// mergeTables merges the tables, with later tables taking precedence, and
+// describes every value that was overridden. Services keep the round-robin
+// position and SRV resolver they had in the previous merged table.
+func mergeTables(tables []*table, previous *table) (*table, []string) {
+	merged := newTable()
+	var conflicts []string
+
+	// sourceConfigs holds the configuration of each service in the last
+	// source defining it, which that source validated.
+	sourceConfigs := make(map[string]ServiceConfig)
+
+	for i, t := range tables {
+		for dn, d := range t.domains {
+			m, ok := merged.domains[dn]
+			if !ok {
+				m = newDomain()
+				merged.domains[dn] = m
+			}
+
+			for prefix, service := range d.services.prefixes {
+				if existing, ok := m.services.prefixes[prefix]; ok && existing != service {
+					conflicts = append(conflicts, fmt.Sprintf("domain %s prefix %q: service %q overridden by %q from source %d", dn, prefix, existing, service, i))
+				}
+				m.setServicePrefix(prefix, service)
+			}
+		}
+
+		for sn, s := range t.services {
+			m, ok := merged.services[sn]
+			if !ok {
+				m = newService()
+				if p, ok := previous.services[sn]; ok {
+					m.index, m.srv = p.index, p.srv
+				}
+				merged.services[sn] = m
+			}
+			sourceConfigs[sn] = s.config
+
+			if len(s.addrs) > 0 {
+				for name, existing := range m.addrs {
+					if addr, ok := s.addrs[name]; !ok {
+						conflicts = append(conflicts, fmt.Sprintf("service %s addr %q: %s dropped by source %d", sn, name, existing, i))
+					} else if existing.String() != addr.String() {
+						conflicts = append(conflicts, fmt.Sprintf("service %s addr %q: %s overridden by %s from source %d", sn, name, existing, addr, i))
+					}
+				}
+
+				m.addrs = make(map[string]net.Addr, len(s.addrs))
+				for name, addr := range s.addrs {
+					m.addrs[name] = addr
+				}
+			}
+
+			for key, value := range s.settings {
+				if existing, ok := m.settings[key]; ok && existing != value {
+					conflicts = append(conflicts, fmt.Sprintf("service %s setting %s: %q overridden by %q from source %d", sn, key, existing, value, i))
+				}
+				m.settings[key] = value
+			}
+		}
+	}
+
+	// Settings were validated by their sources, but settings from different
+	// sources may still not make sense together. Such services keep the
+	// configuration of the last source defining them.
+	for sn, s := range merged.services {
+		s.refigure()
+		config, err := newServiceConfig(s.settings)
+		if err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("service %s settings rejected: %s, using those of its last source", sn, err))
+			config = sourceConfigs[sn]
+		}
+		s.config = config
+		s.refigureSRV()
+	}
+
+	sort.Strings(conflicts)
+	return merged, conflicts
+}
+
+// routingTable returns the merged table, so composite directors can be
+// merged in turn.
+func (c *compositeDirector) routingTable() *table {
+	return c.current()
+}
+
+// Table describes the merged routing table, along with the conflicts
+// between sources.
+func (c *compositeDirector) Table() *TableView {
+	view := c.current().view()
+	view.Conflicts = c.Conflicts()
+	return view
+}
+
+// Pick attempts to match a hostname/path combination with the address of a
+// server that can handle the request.
+func (c *compositeDirector) Pick(hostname, path string) (*Endpoint, error) {
+	endpoint, err := c.current().pick(hostname, path)
+	for i := len(c.sources) - 1; err != nil && i >= 0; i-- {
+		if _, ok := c.sources[i].(tableSource); !ok {
+			endpoint, err = c.sources[i].Pick(hostname, path)
+		}
+	}
+	return endpoint, err
+}
+
+// PickService returns the address of a server of the named service.
+func (c *compositeDirector) PickService(name string) (*Endpoint, error) {
+	endpoint, err := c.current().pickService(name)
+	for i := len(c.sources) - 1; err != nil && i >= 0; i-- {
+		if _, ok := c.sources[i].(tableSource); !ok {
+			endpoint, err = c.sources[i].PickService(name)
+		}
+	}
+	return endpoint, err
+}
+
+// HasService reports whether or not the merged table, or a source that
+// doesn't publish tables, defines the named service. Sources that can't tell
+// are assumed to define it.
+func (c *compositeDirector) HasService(name string) bool {
+	if c.current().hasService(name) {
+		return true
+	}
+
+	for _, source := range c.sources {
+		if _, ok := source.(tableSource); ok {
+			continue
+		}
+		if finder, ok := source.(ServiceFinder); !ok || finder.HasService(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conflicts describes every value of a source that's overridden by a later
+// source.
+func (c *compositeDirector) Conflicts() []string {
+	c.current()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conflicts := make([]string, 0, len(c.conflicts))
+	for conflict := range c.conflicts {
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// Rejections returns the rejected keys of every source.
+func (c *compositeDirector) Rejections() []*Rejection {
+	rejections := []*Rejection{}
+	for _, source := range c.sources {
+		if validator, ok := source.(Validator); ok {
+			rejections = append(rejections, validator.Rejections()...)
+		}
+	}
+	return rejections
+}
+
+// syncRank orders sync states from the most to the least current. A source
+// that's still starting has never loaded any configuration.
+var syncRank = map[SyncState]int{
+	SyncCurrent:   0,
+	SyncResyncing: 1,
+	SyncBackoff:   2,
+	SyncStarting:  3,
+}
+
+// SyncState reports the state of the least current source.
+func (c *compositeDirector) SyncState() SyncState {
+	state := SyncCurrent
+	for _, source := range c.sources {
+		if reporter, ok := source.(SyncReporter); ok {
+			if s := reporter.SyncState(); syncRank[s] > syncRank[state] {
+				state = s
+			}
+		}
+	}
+	return state
+}
+
+// LastConfirmed returns the earliest time any source was last confirmed.
+func (c *compositeDirector) LastConfirmed() time.Time {
+	confirmed := time.Now()
+	for _, source := range c.sources {
+		if reporter, ok := source.(SyncReporter); ok {
+			if t := reporter.LastConfirmed(); t.Before(confirmed) {
+				confirmed = t
+			}
+		}
+	}
+	return confirmed
+}
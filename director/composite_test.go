@@ -0,0 +1,227 @@
+package director
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func setKeys(e *etcdDirector, keys map[string]string) {
+	var batch []*etcd.Response
+	for key, value := range keys {
+		batch = append(batch, &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Value: value}})
+	}
+	applyResponses(e, batch...)
+}
+
+func TestCompositeDirector(t *testing.T) {
+	base := NewEtcdDirector("base", []string{})
+	setKeys(base, map[string]string{
+		"/base/domains/localhost/.service":     "web",
+		"/base/domains/localhost/api/.service": "web",
+		"/base/services/web/1":                 "127.0.0.1:8080",
+		"/base/services/web/.protocol":         "h2c",
+		"/base/services/web/.timeout":          "5s",
+	})
+
+	override := NewEtcdDirector("override", []string{})
+	setKeys(override, map[string]string{
+		"/override/domains/localhost/api/.service": "api",
+		"/override/services/api/1":                 "127.0.0.1:9090",
+		"/override/services/web/2":                 "127.0.0.1:8081",
+		"/override/services/web/.timeout":          "10s",
+	})
+
+	c := NewCompositeDirector(base, override)
+
+	if endpoint, err := c.Pick("localhost", "/api/users"); err != nil {
+		t.Fatal(err)
+	} else if endpoint.Service != "api" {
+		t.Errorf("later source did not take precedence: %+v", endpoint)
+	}
+
+	endpoint, err := c.Pick("localhost", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint.Config.Protocol != ProtocolH2C || endpoint.Config.Timeout.String() != "10s" {
+		t.Errorf("settings weren't merged: %+v", endpoint.Config)
+	}
+
+	if addrs := c.current().services["web"].addrs; len(addrs) != 1 || addrs["2"] == nil {
+		t.Errorf("expected only the addresses of the last source, got %v", addrs)
+	}
+
+	if conflicts := c.Conflicts(); len(conflicts) != 3 {
+		t.Errorf("unexpected conflicts %q", conflicts)
+	}
+
+	// Changes to a source should be picked up by the next pick, keeping the
+	// round-robin position.
+	index := c.current().services["web"].index
+	setKeys(override, map[string]string{"/override/services/api/1": "127.0.0.1:9091"})
+	if endpoint, err := c.PickService("api"); err != nil || endpoint.Addr.String() != "127.0.0.1:9091" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	if c.current().services["web"].index != index {
+		t.Error("rebuild reset the round-robin position")
+	}
+}
+
+func TestCompositeDirectorAddrs(t *testing.T) {
+	base := NewEtcdDirector("base", []string{})
+	setKeys(base, map[string]string{
+		"/base/services/web/1":         "127.0.0.1:8080",
+		"/base/services/web/2":         "127.0.0.1:8081",
+		"/base/services/web/.protocol": "h2c",
+		"/base/services/api/1":         "127.0.0.1:9090",
+	})
+
+	// An override drops an address by leaving it out, and one that only
+	// sets settings keeps the addresses it builds on.
+	override := NewEtcdDirector("override", []string{})
+	setKeys(override, map[string]string{
+		"/override/services/web/1":        "127.0.0.1:8080",
+		"/override/services/api/.timeout": "5s",
+	})
+
+	c := NewCompositeDirector(base, override)
+
+	web := c.current().services["web"]
+	if len(web.addrs) != 1 || web.addrs["1"] == nil || web.config.Protocol != ProtocolH2C {
+		t.Errorf("unexpected service %v %+v", web.addrs, web.config)
+	}
+
+	if n := len(c.current().services["api"].addrs); n != 1 {
+		t.Errorf("expected the base addresses, got %d", n)
+	}
+
+	if conflicts := c.Conflicts(); len(conflicts) != 1 || !strings.Contains(conflicts[0], "dropped") {
+		t.Errorf("unexpected conflicts %q", conflicts)
+	}
+
+	if !c.HasService("web") || c.HasService("missing") {
+		t.Error("services of the merged table weren't found")
+	}
+}
+
+func TestCompositeDirectorFallback(t *testing.T) {
+	base := NewEtcdDirector("base", []string{})
+	setKeys(base, map[string]string{
+		"/base/domains/localhost/.service": "web",
+		"/base/services/web/1":             "127.0.0.1:8080",
+	})
+
+	addr, err := parseAddr("127.0.0.1:7070")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompositeDirector(base, NewStaticDirector(addr))
+
+	if endpoint, err := c.Pick("localhost", "/"); err != nil || endpoint.Service != "web" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	if endpoint, err := c.Pick("example.com", "/"); err != nil || endpoint.Addr != addr {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	// The static director has every service.
+	if !c.HasService("missing") {
+		t.Error("the static director's services weren't found")
+	}
+}
+
+func TestCompositeDirectorSyncState(t *testing.T) {
+	a := NewEtcdDirector("a", []string{})
+	b := NewEtcdDirector("b", []string{})
+	c := NewCompositeDirector(a, b)
+
+	a.setSyncState(SyncCurrent)
+	b.setSyncState(SyncCurrent)
+	if state := c.SyncState(); state != SyncCurrent {
+		t.Errorf("unexpected state %s", state)
+	}
+
+	b.setSyncState(SyncBackoff)
+	if state := c.SyncState(); state != SyncBackoff {
+		t.Errorf("unexpected state %s", state)
+	}
+
+	if confirmed := c.LastConfirmed(); !confirmed.Equal(b.LastConfirmed()) {
+		t.Errorf("unexpected confirmation time %s", confirmed)
+	}
+}
+
+func TestCompositeDirectorNested(t *testing.T) {
+	shared := NewEtcdDirector("shared", []string{})
+	setKeys(shared, map[string]string{
+		"/shared/domains/localhost/.service": "web",
+		"/shared/services/web/1":             "127.0.0.1:8080",
+	})
+
+	team := NewEtcdDirector("team", []string{})
+	setKeys(team, map[string]string{
+		"/team/domains/localhost/.service": "team",
+		"/team/services/team/1":            "unix:///run/team.sock",
+	})
+
+	c := NewCompositeDirector(NewCompositeDirector(shared), team)
+
+	view := c.Table()
+	if view.Domains["localhost"][""] != "team" {
+		t.Errorf("unexpected domains %v", view.Domains)
+	}
+
+	if addr := view.Services["team"].Addrs["1"]; addr != "unix:///run/team.sock" {
+		t.Errorf("unexpected team addr %q", addr)
+	}
+
+	if len(view.Services) != 2 || len(view.Conflicts) != 1 {
+		t.Errorf("unexpected view %+v", view)
+	}
+
+	// Changes to the inner composite's sources should reach the outer one.
+	setKeys(shared, map[string]string{"/shared/services/web/1": "127.0.0.1:8081"})
+	if endpoint, err := c.PickService("web"); err != nil || endpoint.Addr.String() != "127.0.0.1:8081" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+}
+
+func TestCompositeDirectorCurrentAllocs(t *testing.T) {
+	base := NewEtcdDirector("base", []string{})
+	setKeys(base, map[string]string{"/base/services/web/1": "127.0.0.1:8080"})
+	c := NewCompositeDirector(base, NewEtcdDirector("override", []string{}))
+	c.current()
+
+	if allocs := testing.AllocsPerRun(100, func() { c.current() }); allocs != 0 {
+		t.Errorf("expected no allocations for an unchanged table, got %v", allocs)
+	}
+}
+
+func TestMergeTablesRejectedSettings(t *testing.T) {
+	base := newTable()
+	base.services["web"] = newService()
+	base.services["web"].settings["timeout"] = "5s"
+
+	// Sources validate their settings, but a merged combination can still
+	// be rejected, as this invalid setting stands in for.
+	override := newTable()
+	override.services["web"] = newService()
+	override.services["web"].settings["protocol"] = "gopher"
+	override.services["web"].config = ServiceConfig{Protocol: ProtocolH2C}
+
+	merged, conflicts := mergeTables([]*table{base, override}, newTable())
+
+	if len(conflicts) != 1 || !strings.Contains(conflicts[0], "service web settings rejected") {
+		t.Errorf("unexpected conflicts %q", conflicts)
+	}
+
+	if config := merged.services["web"].config; config != override.services["web"].config {
+		t.Errorf("expected the last source's config, got %+v", config)
+	}
+}
@@ -0,0 +1,169 @@
+package director
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+	ProtocolFCGI  = "fcgi"
+)
+
+var (
+	unknownSettingError  = errors.New("unknown service setting")
+	unknownProtocolError = errors.New("unknown protocol")
+	negativeSettingError = errors.New("setting must not be negative")
+)
+
+// ServiceConfig describes how to connect to the addresses of a service. The
+// zero value is plain HTTP with no TLS options. It's a comparable value, so
+// two configs can be checked for equality with ==.
+type ServiceConfig struct {
+
+	// Protocol is one of http, https, h2, h2c or fcgi.
+	Protocol string
+
+	// TLSCA, TLSCert and TLSKey each hold either PEM data or the path to a
+	// PEM file.
+	TLSCA, TLSCert, TLSKey string
+
+	// TLSServerName overrides the name used for SNI and certificate
+	// verification. Services reached over TLS on a unix socket need it,
+	// since their addresses have no hostname.
+	TLSServerName string
+
+	// TLSInsecureSkipVerify disables certificate verification. It's only
+	// meant for development.
+	TLSInsecureSkipVerify bool
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout limit the
+	// corresponding phases of a request. Timeout limits the whole exchange,
+	// including reading the response body. Zero means no limit.
+	DialTimeout, TLSHandshakeTimeout, ResponseHeaderTimeout, Timeout time.Duration
+
+	// MaxIdleConns limits the idle connections kept per address, and
+	// IdleTimeout closes idle connections after the given duration. Zero means
+	// the transport defaults.
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+
+	// FCGIDocumentRoot is the directory scripts are found in on the FastCGI
+	// responder. FCGIIndex, when set, names a script that handles every
+	// request under the route, such as a PHP front controller.
+	FCGIDocumentRoot, FCGIIndex string
+
+	// SRV is a DNS SRV name the service's targets are looked up with, such as
+	// _http._tcp.api.internal, optionally followed by @host:port to ask a
+	// particular nameserver. Explicit addresses are used when the lookup
+	// fails or finds no targets.
+	SRV string
+}
+
+// TLS reports whether or not the protocol is carried over TLS.
+func (c ServiceConfig) TLS() bool {
+	return c.Protocol == ProtocolHTTPS || c.Protocol == ProtocolH2
+}
+
+// Scheme returns the URL scheme for requests to the service.
+func (c ServiceConfig) Scheme() string {
+	if c.TLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// validateSetting checks a single service setting without applying it.
+func validateSetting(key, value string) error {
+	var c ServiceConfig
+	return c.set(key, value)
+}
+
+// set applies a single service setting to the config.
+func (c *ServiceConfig) set(key, value string) error {
+	switch key {
+	case "protocol":
+		switch value {
+		case ProtocolHTTP, ProtocolHTTPS, ProtocolH2, ProtocolH2C, ProtocolFCGI:
+			c.Protocol = value
+		default:
+			return unknownProtocolError
+		}
+	case "tls_ca":
+		c.TLSCA = value
+	case "tls_cert":
+		c.TLSCert = value
+	case "tls_key":
+		c.TLSKey = value
+	case "tls_server_name":
+		c.TLSServerName = value
+	case "tls_insecure_skip_verify":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		c.TLSInsecureSkipVerify = b
+	case "dial_timeout":
+		return parseDuration(value, &c.DialTimeout)
+	case "tls_handshake_timeout":
+		return parseDuration(value, &c.TLSHandshakeTimeout)
+	case "response_header_timeout":
+		return parseDuration(value, &c.ResponseHeaderTimeout)
+	case "timeout":
+		return parseDuration(value, &c.Timeout)
+	case "idle_timeout":
+		return parseDuration(value, &c.IdleTimeout)
+	case "fcgi_document_root":
+		c.FCGIDocumentRoot = value
+	case "fcgi_index":
+		c.FCGIIndex = value
+	case "srv":
+		if _, _, err := parseSRVSetting(value); err != nil {
+			return err
+		}
+		c.SRV = value
+	case "max_idle_conns":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return negativeSettingError
+		}
+		c.MaxIdleConns = n
+	default:
+		return unknownSettingError
+	}
+
+	return nil
+}
+
+// parseDuration parses a non-negative duration such as "1.5s" into d.
+func parseDuration(value string, d *time.Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return negativeSettingError
+	}
+
+	*d = parsed
+	return nil
+}
+
+// newServiceConfig builds a config from a map of setting names to values.
+func newServiceConfig(settings map[string]string) (ServiceConfig, error) {
+	c := ServiceConfig{Protocol: ProtocolHTTP}
+	for key, value := range settings {
+		if err := c.set(key, value); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,65 @@
+package director
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceConfig(t *testing.T) {
+	c, err := newServiceConfig(map[string]string{
+		"protocol":                 "h2",
+		"tls_server_name":          "backend.internal",
+		"tls_insecure_skip_verify": "true",
+		"timeout":                  "1.5s",
+		"max_idle_conns":           "8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.TLS() || c.Scheme() != "https" {
+		t.Error("h2 should be carried over TLS")
+	}
+
+	if c.TLSServerName != "backend.internal" || !c.TLSInsecureSkipVerify {
+		t.Error("TLS settings were not applied")
+	}
+
+	if c.Timeout != 1500*time.Millisecond || c.MaxIdleConns != 8 {
+		t.Error("transport settings were not applied")
+	}
+
+	if err := validateSetting("protocol", "gopher"); err == nil {
+		t.Error("no error reported for an unknown protocol")
+	}
+
+	if err := validateSetting("dial_timeout", "-1s"); err == nil {
+		t.Error("no error reported for a negative timeout")
+	}
+
+	if err := validateSetting("max_idle_conns", "many"); err == nil {
+		t.Error("no error reported for an invalid connection count")
+	}
+
+	if err := validateSetting("color", "blue"); err == nil {
+		t.Error("no error reported for an unknown setting")
+	}
+}
+
+func TestServiceSetting(t *testing.T) {
+	s := newService()
+
+	if err := s.setSetting("protocol", "h2c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.config.Protocol != ProtocolH2C || s.config.TLS() {
+		t.Error("protocol setting was not applied")
+	}
+
+	s.removeSetting("protocol")
+
+	if s.config.Protocol != ProtocolHTTP {
+		t.Error("protocol setting was not removed")
+	}
+}
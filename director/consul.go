@@ -0,0 +1,425 @@
+package director
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+
+	// DefaultConsulWait is the default time a blocking query waits for a
+	// change before Consul responds anyway.
+	DefaultConsulWait = 5 * time.Minute
+
+	// consulKV and consulCatalog name the queries every consul director
+	// follows, besides the health of each service.
+	consulKV      = "kv"
+	consulCatalog = "catalog"
+)
+
+var (
+	// consulStats exposes statistics for every consul director, keyed by
+	// root key.
+	consulStats = expvar.NewMap("consul")
+)
+
+// consulKVPair is an entry of a recursive KV read. Values are base64
+// encoded, which encoding/json decodes for byte slices.
+type consulKVPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+// consulServiceEntry is a passing instance of a service, as returned by the
+// health endpoint.
+type consulServiceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string `json:"ID"`
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// consulDirector routes according to Consul. Services are built from the
+// passing instances in Consul's catalog, and domains from keys in Consul's
+// KV store under the root key, following the same layout as etcd keys:
+//
+//	promise/domains/example.com/api/.service = "api"
+//	promise/services/api/.protocol = "h2c"
+//
+// A service can also route domains itself, with tags of the form
+// <root key>.route=<domain>[/<prefix>], such as promise.route=example.com/api.
+// KV keys take precedence over tags.
+//
+// Every source is followed with a blocking query, so changes are applied as
+// soon as Consul reports them.
+type consulDirector struct {
+	*keyState
+	syncTracker
+
+	addr   string
+	client *http.Client
+
+	// Token, if set, is the ACL token sent with every request. It should be
+	// set before calling Watch.
+	Token string
+
+	// Wait is the longest time a blocking query waits for a change. The
+	// routing table is confirmed as queries return, so staleness thresholds
+	// should exceed it. It should be set before calling Watch.
+	Wait time.Duration
+
+	// MinBackoff and MaxBackoff bound the randomized, exponentially growing
+	// delay between attempts to reach Consul after an error. They should be
+	// set before calling Watch.
+	MinBackoff, MaxBackoff time.Duration
+
+	// The state of every followed query is guarded by its own mutex, since
+	// it's combined into keys before being applied.
+	sourceLock sync.Mutex
+
+	// kv holds the keys under the root key, tags the tags of every service in
+	// the catalog, and instances the address keys of every service's passing
+	// instances.
+	kv        map[string]string
+	tags      map[string][]string
+	instances map[string]map[string]string
+
+	// watchers cancels the health query of every service in the catalog.
+	watchers map[string]context.CancelFunc
+
+	// loaded and failing record which queries have succeeded at least once,
+	// and which are failing.
+	loaded, failing map[string]bool
+
+	// stats holds the expvar statistics of the director.
+	stats *expvar.Map
+}
+
+// NewConsulDirector returns a director for the keys and services of the
+// Consul agent at the address, such as http://127.0.0.1:8500.
+func NewConsulDirector(rootKey, addr string) *consulDirector {
+	c := &consulDirector{
+		keyState:    newKeyState(rootKey),
+		syncTracker: syncTracker{name: rootKey},
+		addr:        strings.TrimSuffix(addr, "/"),
+		client:      &http.Client{},
+		Wait:        DefaultConsulWait,
+		MinBackoff:  DefaultMinBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		kv:          make(map[string]string),
+		tags:        make(map[string][]string),
+		instances:   make(map[string]map[string]string),
+		watchers:    make(map[string]context.CancelFunc),
+		loaded:      make(map[string]bool),
+		failing:     make(map[string]bool),
+	}
+	c.stats = newStats(consulStats, c.keyState, &c.syncTracker)
+
+	return c
+}
+
+// rootPath returns the root key as a KV path, without any leading or
+// trailing slashes.
+func (c *consulDirector) rootPath() string {
+	return strings.Trim(c.rootKey, "/")
+}
+
+// consulWait formats the wait time of a blocking query in milliseconds, so
+// waits shorter than a second aren't rounded down to zero, which would turn
+// the query into a poll. It waits at least a millisecond.
+func consulWait(wait time.Duration) string {
+	ms := int64(wait / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10) + "ms"
+}
+
+// get performs a blocking query, which responds once the index of the
+// resource moves past the given one, or after the wait time. It decodes the
+// response and returns the new index. A missing resource leaves the response
+// untouched.
+func (c *consulDirector) get(ctx context.Context, path string, query url.Values, index uint64, response interface{}) (uint64, error) {
+	if query == nil {
+		query = make(url.Values)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait(c.Wait))
+	}
+
+	// Consul adds up to a sixteenth of the wait time as jitter, and the
+	// request itself needs some time on top.
+	ctx, cancel := context.WithTimeout(ctx, c.Wait+c.Wait/16+10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.addr+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return 0, err
+		}
+	case http.StatusNotFound:
+	default:
+		return 0, fmt.Errorf("consul: %s responded %s", path, resp.Status)
+	}
+
+	return strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+}
+
+// follow repeats a blocking query until the context is canceled, backing off
+// after errors. The fetch function performs the query, applying any changes.
+func (c *consulDirector) follow(ctx context.Context, name string, fetch func(ctx context.Context, index uint64) (uint64, error)) {
+	delays := &backoff{min: c.MinBackoff, max: c.MaxBackoff}
+
+	var index uint64
+	for ctx.Err() == nil {
+		next, err := fetch(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := delays.next()
+			log.WithFields(log.Fields{"prefix": c.rootKey, "query": name, "retry_in": delay}).Error(err)
+			c.stats.Add("errors", 1)
+			c.report(name, err)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		delays.reset()
+		c.report(name, nil)
+
+		// An index that goes backwards means Consul's state was reset, so the
+		// next query shouldn't block.
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+// report records the result of a query and updates the sync state. The
+// director is current once the KV store and the catalog have been read and
+// while no query is failing.
+func (c *consulDirector) report(name string, err error) {
+	c.sourceLock.Lock()
+	defer c.sourceLock.Unlock()
+
+	c.failing[name] = err != nil
+	if err == nil {
+		c.loaded[name] = true
+	}
+
+	state := SyncStarting
+	if c.loaded[consulKV] && c.loaded[consulCatalog] {
+		state = SyncCurrent
+	}
+	for _, failing := range c.failing {
+		if failing {
+			state = SyncBackoff
+		}
+	}
+
+	if state == SyncCurrent {
+		c.confirm()
+		c.markConfirmed()
+	}
+	c.setSyncState(state)
+}
+
+// fetchKV reads the keys under the root key.
+func (c *consulDirector) fetchKV(ctx context.Context, index uint64) (uint64, error) {
+	var pairs []*consulKVPair
+	query := url.Values{"recurse": {"true"}}
+	next, err := c.get(ctx, "/v1/kv/"+c.rootPath()+"/", query, index, &pairs)
+	if err != nil || next == index {
+		return next, err
+	}
+
+	kv := make(map[string]string)
+	for _, pair := range pairs {
+
+		// Folders are keys ending with a slash, without a value.
+		if !strings.HasSuffix(pair.Key, "/") {
+			kv["/"+pair.Key] = string(pair.Value)
+		}
+	}
+
+	c.sourceLock.Lock()
+	c.kv = kv
+	c.sourceLock.Unlock()
+
+	c.rebuild()
+	return next, nil
+}
+
+// fetchCatalog reads the services in the catalog, starting and stopping the
+// health queries of services as they come and go.
+func (c *consulDirector) fetchCatalog(ctx context.Context, index uint64) (uint64, error) {
+	var services map[string][]string
+	next, err := c.get(ctx, "/v1/catalog/services", nil, index, &services)
+	if err != nil || next == index {
+		return next, err
+	}
+
+	c.sourceLock.Lock()
+	c.tags = services
+	for sn, cancel := range c.watchers {
+		if _, ok := services[sn]; !ok {
+			cancel()
+			delete(c.watchers, sn)
+			delete(c.instances, sn)
+			delete(c.loaded, "health/"+sn)
+			delete(c.failing, "health/"+sn)
+		}
+	}
+
+	for sn := range services {
+		if _, ok := c.watchers[sn]; !ok {
+			serviceCtx, cancel := context.WithCancel(ctx)
+			c.watchers[sn] = cancel
+
+			sn := sn
+			go c.follow(serviceCtx, "health/"+sn, func(ctx context.Context, index uint64) (uint64, error) {
+				return c.fetchHealth(ctx, sn, index)
+			})
+		}
+	}
+	c.sourceLock.Unlock()
+
+	c.rebuild()
+	return next, nil
+}
+
+// fetchHealth reads the passing instances of a service.
+func (c *consulDirector) fetchHealth(ctx context.Context, sn string, index uint64) (uint64, error) {
+	var entries []*consulServiceEntry
+	query := url.Values{"passing": {"true"}}
+	next, err := c.get(ctx, "/v1/health/service/"+url.PathEscape(sn), query, index, &entries)
+	if err != nil || next == index {
+		return next, err
+	}
+
+	instances := make(map[string]string)
+	for _, entry := range entries {
+
+		// Instances without their own address use their node's.
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+
+		// Service IDs are only unique per node.
+		name := url.PathEscape(entry.Node.Node + ":" + entry.Service.ID)
+		instances[serviceKey(c.rootKey, sn, name)] = net.JoinHostPort(host, strconv.Itoa(entry.Service.Port))
+	}
+
+	// Ignore the result if the service left the catalog in the meantime.
+	c.sourceLock.Lock()
+	current := ctx.Err() == nil
+	if current {
+		c.instances[sn] = instances
+	}
+	c.sourceLock.Unlock()
+
+	if current {
+		c.rebuild()
+	}
+	return next, nil
+}
+
+// nodes combines the state of every query into configuration keys. It
+// expects the caller to hold the source lock.
+func (c *consulDirector) nodes() map[string]string {
+	nodes := make(map[string]string)
+
+	routeTag := c.rootPath() + ".route="
+	for sn, tags := range c.tags {
+		for _, tag := range tags {
+			if !strings.HasPrefix(tag, routeTag) {
+				continue
+			}
+
+			route := strings.TrimPrefix(tag, routeTag)
+			dn, prefix := route, ""
+			if i := strings.Index(route, "/"); i >= 0 {
+				dn, prefix = route[:i], route[i+1:]
+			}
+			nodes[domainKey(c.rootKey, dn, prefix)] = sn
+		}
+	}
+
+	for _, instances := range c.instances {
+		for key, value := range instances {
+			nodes[key] = value
+		}
+	}
+
+	for key, value := range c.kv {
+		nodes[key] = value
+	}
+
+	return nodes
+}
+
+// rebuild reconciles the routing table with the state of every query. The
+// source lock is held throughout, so that updates are applied in order.
+func (c *consulDirector) rebuild() {
+	c.sourceLock.Lock()
+	defer c.sourceLock.Unlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reconcile(c.nodes())
+	c.commit()
+}
+
+// Watch follows Consul for any configuration updates and applies them to the
+// director. It's meant to run consistently and only log errors it encounters.
+func (c *consulDirector) Watch() {
+	c.confirmedAt(c.loadSnapshot())
+
+	ctx := context.Background()
+	go c.follow(ctx, consulKV, c.fetchKV)
+	c.follow(ctx, consulCatalog, c.fetchCatalog)
+}
@@ -0,0 +1,174 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul serves the parts of the Consul HTTP API the director uses.
+// Blocking queries wait until the index changes, or briefly otherwise.
+type fakeConsul struct {
+	lock    sync.Mutex
+	changed chan struct{}
+	index   uint64
+
+	kv       map[string]string
+	services map[string][]string
+	health   map[string][]*consulServiceEntry
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		changed:  make(chan struct{}),
+		index:    1,
+		kv:       make(map[string]string),
+		services: make(map[string][]string),
+		health:   make(map[string][]*consulServiceEntry),
+	}
+}
+
+// update changes the state of the fake and wakes any blocking queries.
+func (f *fakeConsul) update(change func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	change()
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	if index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64); index == f.index {
+		changed := f.changed
+		f.lock.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(50 * time.Millisecond):
+		}
+		f.lock.Lock()
+	}
+	defer f.lock.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+
+	var response interface{}
+	switch path := req.URL.Path; {
+	case path == "/v1/kv/promise/":
+		var pairs []*consulKVPair
+		for key, value := range f.kv {
+			pairs = append(pairs, &consulKVPair{Key: key, Value: []byte(value)})
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		response = pairs
+	case path == "/v1/catalog/services":
+		response = f.services
+	case len(path) > len("/v1/health/service/"):
+		response = f.health[path[len("/v1/health/service/"):]]
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func consulEntry(node, id, address string, port int) *consulServiceEntry {
+	entry := &consulServiceEntry{}
+	entry.Node.Node = node
+	entry.Node.Address = "10.0.0.1"
+	entry.Service.ID = id
+	entry.Service.Address = address
+	entry.Service.Port = port
+	return entry
+}
+
+func TestConsulDirector(t *testing.T) {
+	fake := newFakeConsul()
+	fake.services["web"] = []string{"promise.route=localhost"}
+	fake.services["api"] = []string{"other", "promise.route=localhost/api/"}
+	fake.health["web"] = []*consulServiceEntry{consulEntry("a", "web", "", 8080), consulEntry("b", "web", "10.0.0.2", 8080)}
+	fake.health["api"] = []*consulServiceEntry{consulEntry("a", "api", "", 9090)}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	c := NewConsulDirector("promise", server.URL)
+	c.Wait = time.Second
+	go c.Watch()
+
+	waitFor(t, func() bool {
+		return c.SyncState() == SyncCurrent
+	})
+	waitFor(t, func() bool {
+		_, err := c.Pick("localhost", "/api/users")
+		return err == nil
+	})
+
+	if endpoint, err := c.Pick("localhost", "/api/users"); err != nil {
+		t.Fatal(err)
+	} else if endpoint.Service != "api" || endpoint.Addr.String() != "10.0.0.1:9090" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	waitFor(t, func() bool {
+		web := c.table.Load().services["web"]
+		return web != nil && len(web.addrs) == 2
+	})
+
+	// An instance failing its health checks should be removed.
+	fake.update(func() {
+		fake.health["web"] = fake.health["web"][1:]
+	})
+	waitFor(t, func() bool {
+		return len(c.table.Load().services["web"].addrs) == 1
+	})
+
+	if endpoint, err := c.Pick("localhost", "/"); err != nil {
+		t.Fatal(err)
+	} else if endpoint.Addr.String() != "10.0.0.2:8080" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	// KV keys should override tags and configure services.
+	fake.update(func() {
+		fake.kv["promise/"] = ""
+		fake.kv["promise/domains/localhost/.service"] = "api"
+		fake.kv["promise/services/api/.protocol"] = "h2c"
+	})
+	waitFor(t, func() bool {
+		endpoint, err := c.Pick("localhost", "/")
+		return err == nil && endpoint.Service == "api" && endpoint.Config.Protocol == ProtocolH2C
+	})
+
+	// Services leaving the catalog should be removed.
+	fake.update(func() {
+		delete(fake.services, "web")
+	})
+	waitFor(t, func() bool {
+		_, err := c.PickService("web")
+		return err == undefinedServiceError
+	})
+}
+
+func TestConsulWait(t *testing.T) {
+	for wait, expected := range map[time.Duration]string{
+		DefaultConsulWait:      "300000ms",
+		time.Second:            "1000ms",
+		500 * time.Millisecond: "500ms",
+		0:                      "1ms",
+	} {
+		if formatted := consulWait(wait); formatted != expected {
+			t.Errorf("%s: expected %s, got %s", wait, expected, formatted)
+		}
+	}
+}
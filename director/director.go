@@ -5,5 +5,28 @@ import (
 )
 
 type Director interface {
-	Pick(hostname, path string) (*net.TCPAddr, error)
+
+	// Pick routes a request by hostname and path to an endpoint.
+	Pick(hostname, path string) (*Endpoint, error)
+
+	// PickService returns an endpoint of the named service directly, for
+	// listeners that don't route by hostname and path.
+	PickService(name string) (*Endpoint, error)
+}
+
+// ServiceFinder is implemented by directors that can tell whether or not they
+// define a service without picking an endpoint of it, which would advance the
+// service's round-robin position.
+type ServiceFinder interface {
+	HasService(name string) bool
+}
+
+// Endpoint is an upstream address picked by a Director, along with the
+// configuration of the service it belongs to. Prefix is the domain path
+// prefix that matched the request.
+type Endpoint struct {
+	Service string
+	Prefix  string
+	Addr    net.Addr
+	Config  ServiceConfig
 }
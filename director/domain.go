@@ -10,6 +10,13 @@ func newDomain() *domain {
 	}
 }
 
+// clone returns a copy of the domain that can be changed independently.
+func (d *domain) clone() *domain {
+	return &domain{
+		services: d.services.clone(),
+	}
+}
+
 // setServicePrefix adds a prefix/service pair to the domain.
 func (d *domain) setServicePrefix(prefix, service string) {
 	d.services.setPrefix(prefix, service)
@@ -20,6 +27,16 @@ func (d *domain) removeServicePrefix(prefix string) {
 	d.services.removePrefix(prefix)
 }
 
+// empty reports whether or not the domain has any prefixes left.
+func (d *domain) empty() bool {
+	return len(d.services.prefixes) == 0
+}
+
 func (d *domain) pick(path string) (string, error) {
 	return d.services.match(path)
 }
+
+// route returns the matching prefix along with the name of its service.
+func (d *domain) route(path string) (string, string, error) {
+	return d.services.matchPrefix(path)
+}
@@ -2,10 +2,7 @@ package director
 
 import (
 	"errors"
-	"fmt"
-	"net"
-	"strings"
-	"sync"
+	"expvar"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -15,311 +12,308 @@ import (
 const (
 	domainsKind  = "domains"
 	servicesKind = "services"
+
+	// etcdKeyNotFound and etcdEventIndexCleared are the etcd error codes for a
+	// missing key and for a watch index that's older than the history etcd
+	// keeps.
+	etcdKeyNotFound       = 100
+	etcdEventIndexCleared = 401
+
+	// commitKey is the name of the key, directly under the root key, that
+	// marks the configuration as transactional.
+	commitKey = ".commit"
+
+	// statusKey is the name of the key, directly under the root key, the
+	// director reports rejected keys in.
+	statusKey = ".status"
+
+	// DefaultBatchWindow is the default time to wait for further etcd updates
+	// before applying a batch.
+	DefaultBatchWindow = 50 * time.Millisecond
+
+	// DefaultMinBackoff and DefaultMaxBackoff bound the delay between attempts
+	// to reach etcd after an error.
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = time.Minute
+
+	// DefaultConfirmInterval is the default time between checks that etcd
+	// is still reachable while a watch is quiet.
+	DefaultConfirmInterval = 10 * time.Second
+)
+
+var (
+	// etcdStats exposes statistics for every etcd director, keyed by root key.
+	etcdStats = expvar.NewMap("etcd")
 )
 
 var (
 	undefinedDomainError  = errors.New("domain not defined")
 	undefinedServiceError = errors.New("service not defined")
 	nodeComponentsError   = errors.New("node has the wrong number of components")
+	unknownKindError      = errors.New("unknown kind")
+	unknownCommandError   = errors.New("unknown command")
 )
 
-type etcdParsedNode struct {
-	kind, name, detail, value string
-}
-
-func newParsedNode(etcdRootKey string, node *etcd.Node) (*etcdParsedNode, error) {
-
-	// Parse the key.
-	key := strings.TrimPrefix(node.Key, fmt.Sprintf("/%s/", etcdRootKey))
-	keyComponents := strings.SplitN(key, "/", 3)
-	if len(keyComponents) != 3 {
-		return nil, nodeComponentsError
-	}
+// etcdDirector routes according to keys under a root key in etcd, read
+// through either the v2 or the v3 API. Its keys are read and watched by an
+// EtcdCluster, which may share its watch with the directors of other root
+// keys.
+type etcdDirector struct {
+	*keyState
+	syncTracker
 
-	return &etcdParsedNode{
-		kind:   keyComponents[0],
-		name:   keyComponents[1],
-		detail: keyComponents[2],
-		value:  node.Value,
-	}, nil
-}
+	etcdRootKey string
 
-func (e *etcdParsedNode) fields() log.Fields {
-	return log.Fields{
-		"kind":   e.kind,
-		"name":   e.name,
-		"detail": e.detail,
-		"value":  e.value,
-	}
-}
+	// cluster watches the director's keys, and writes its status.
+	cluster *EtcdCluster
 
-type etcdDirector struct {
-	client      *etcd.Client
-	etcdRootKey string
+	// WriteStatus enables reporting rejected keys to etcd, as JSON in the
+	// .status key under the root key. It should be set before calling Watch.
+	WriteStatus bool
 
-	// Access to the routing information is controlled by a read/write mutext.
-	lock     sync.RWMutex
-	domains  map[string]*domain
-	services map[string]*service
+	// stats holds the expvar statistics of the director.
+	stats         *expvar.Map
+	lastBatchSize *expvar.Int
 }
 
+// NewEtcdDirector returns a director for the keys under the root key, with
+// its own client and watch, reading them through the etcd v2 API. Directors
+// of several root keys in the same cluster can share both through an
+// EtcdCluster instead.
 func NewEtcdDirector(etcdRootKey string, machines []string) *etcdDirector {
-	return &etcdDirector{
-		etcdRootKey: etcdRootKey,
-		client:      etcd.NewClient(machines),
-		domains:     make(map[string]*domain),
-		services:    make(map[string]*service),
-	}
+	return NewEtcdCluster(machines).Director(etcdRootKey)
 }
 
-// getDomain will return the domain of the given name. If that domain is
-// missing, it will create a new domain, store it, and return it.
-func (b *etcdDirector) getDomain(name string) *domain {
-
-	// Check if we've seen this hostname.
-	if d, ok := b.domains[name]; ok {
-		return d
+func newEtcdDirector(etcdRootKey string, cluster *EtcdCluster) *etcdDirector {
+	b := &etcdDirector{
+		keyState:      newKeyState(etcdRootKey),
+		syncTracker:   syncTracker{name: etcdRootKey},
+		etcdRootKey:   etcdRootKey,
+		cluster:       cluster,
+		lastBatchSize: new(expvar.Int),
 	}
 
-	// Create a new group and return it.
-	b.domains[name] = newDomain()
-	return b.domains[name]
-}
+	b.stats = newStats(cluster.stats, b.keyState, &b.syncTracker)
+	b.stats.Set("last_batch_size", b.lastBatchSize)
 
-// getService will return the service of the given name. If that service
-// is missing, it will create a new service, store it, and return it.
-func (b *etcdDirector) getService(name string) *service {
-
-	// Check if we've seen this hostname.
-	if s, ok := b.services[name]; ok {
-		return s
-	}
-
-	// Create a new group and return it.
-	b.services[name] = newService()
-	return b.services[name]
+	return b
 }
 
-func (b *etcdDirector) processDomainService(dn, prefix, service string, add bool) {
-
-	// Get the domain and set a map of fields for logging.
-	d := b.getDomain(dn)
-	fields := log.Fields{
-		"dn":      dn,
-		"prefix":  prefix,
-		"service": service,
+// applyEvent reflects a single change in the pending table. A change to the
+// commit key publishes the changes staged before it right away, so changes
+// after it in the same batch wait for the next commit. It expects the caller
+// to hold the lock.
+func (b *etcdDirector) applyEvent(event keyEvent) {
+	if event.deleted {
+		b.deleteKey(event.key)
+	} else {
+		b.setKey(event.key, event.value)
 	}
 
-	// Check whether or not this action is additive.
-	if add {
-		d.setServicePrefix(prefix, service)
-		log.WithFields(fields).Info("+ domain service prefix")
-	} else {
-		d.removeServicePrefix(prefix)
-		log.WithFields(fields).Info("- domain service prefix")
+	if b.committed {
+		b.commit()
 	}
 }
 
-func (b *etcdDirector) processDomainNode(e *etcdParsedNode, add bool) {
-
-	// Parse the detail into components and set the command.
-	detailComponents := strings.Split(e.detail, "/")
-	command := detailComponents[len(detailComponents)-1]
-
-	// Determine the prefix from the remaining components.
-	var prefix string
-	if len(detailComponents) > 1 {
-		prefix = strings.Join(detailComponents[:len(detailComponents)-2], "/")
+// applyBatch reflects a batch of watch updates in the routing table as a
+// single update, logging a summary instead of every change.
+func (b *etcdDirector) applyBatch(batch []*keyUpdate) {
+	b.lock.Lock()
+	for _, u := range batch {
+		for _, event := range u.events {
+			b.applyEvent(event)
+		}
 	}
+	b.commit()
+	b.lock.Unlock()
 
-	// Switch on the command.
-	switch command {
-	case ".service":
-		b.processDomainService(e.name, prefix, e.value, add)
-	default:
-		log.WithFields(e.fields()).WithField("command", command).Error("unknown command")
-	}
+	b.markConfirmed()
+	b.recordBatch(batch)
+	b.reportStatus()
 }
 
-func (b *etcdDirector) processServiceAddr(sn, name string, addr *net.TCPAddr, add bool) {
-
-	// Get the domain and set a map of fields for logging.
-	s := b.getService(sn)
-	fields := log.Fields{
-		"sn":   sn,
-		"name": name,
-		"addr": addr.String(),
+// recordBatch updates the statistics and logs a summary of an applied batch.
+func (b *etcdDirector) recordBatch(batch []*keyUpdate) {
+	var sets, deletes int
+	for _, u := range batch {
+		for _, event := range u.events {
+			if event.deleted {
+				deletes++
+			} else {
+				sets++
+			}
+		}
 	}
 
-	// Check whether or not this action is additive.
-	if add {
-		s.setAddr(name, addr)
-		log.WithFields(fields).Info("+ service addr")
-	} else {
-		s.removeAddr(name)
-		log.WithFields(fields).Info("- service addr")
-	}
+	b.stats.Add("batches", 1)
+	b.stats.Add("batched_responses", int64(len(batch)))
+	b.lastBatchSize.Set(int64(len(batch)))
+
+	log.WithFields(log.Fields{
+		"prefix":      b.etcdRootKey,
+		"size":        len(batch),
+		"first_index": batch[0].index,
+		"last_index":  batch[len(batch)-1].index,
+		"set":         sets,
+		"delete":      deletes,
+	}).Info("batch")
 }
 
-func (b *etcdDirector) processServiceNode(e *etcdParsedNode, add bool) {
-
-	// Parse the address.
-	addr, err := net.ResolveTCPAddr("tcp", e.value)
-	if err != nil {
-		log.WithFields(e.fields()).Error(err)
+// reportStatus writes the rejected keys to the status key, if that's enabled
+// and they've changed since the last report.
+func (b *etcdDirector) reportStatus() {
+	if !b.WriteStatus {
 		return
 	}
 
-	// Check for a valid port.
-	if add && addr.Port <= 0 {
-		log.WithFields(e.fields()).WithField("port", addr.Port).Error("invalid port")
+	status, changed := b.statusUpdate()
+	if !changed {
 		return
 	}
 
-	// Process the service addr.
-	b.processServiceAddr(e.name, e.detail, addr, add)
+	if err := b.cluster.backend.put(b.reservedKeyPath(statusKey), status); err != nil {
+		log.WithField("prefix", b.etcdRootKey).Error(err)
+		b.statusFailed()
+	}
+}
+
+// Watch monitors etcd for any configuration updates and applies them to the
+// director, along with the other directors of its cluster. It's meant to run
+// consistently and only log errors it encounters. Only the first call to the
+// Watch method of the cluster or any of its directors runs the watch: later
+// calls hand their directors to it and return immediately.
+func (b *etcdDirector) Watch() {
+	b.cluster.watch(b)
 }
 
-func (b *etcdDirector) nodeAction(node *etcd.Node, add bool) {
+// etcdBackend reads and watches keys through the etcd v2 API.
+type etcdBackend struct {
+	client *etcd.Client
+}
 
-	// Check if the node is a directory.
-	if node.Dir {
+func newEtcdBackend(machines []string) *etcdBackend {
+	return &etcdBackend{client: etcd.NewClient(machines)}
+}
 
-		// Recurse to find leaves.
+// collectNodes adds the value of every leaf under the node to the map.
+func collectNodes(node *etcd.Node, nodes map[string]string) {
+	if node.Dir {
 		for _, next := range node.Nodes {
-			b.nodeAction(next, add)
+			collectNodes(next, nodes)
 		}
 	} else {
-
-		parsedNode, err := newParsedNode(b.etcdRootKey, node)
-		if err != nil {
-			log.Error(err)
-		} else {
-
-			// Check what kind of node this is.
-			switch parsedNode.kind {
-			case domainsKind:
-				b.processDomainNode(parsedNode, add)
-			case servicesKind:
-				b.processServiceNode(parsedNode, add)
-			default:
-				log.WithFields(parsedNode.fields()).Error("unknown kind")
-			}
-		}
+		nodes[node.Key] = node.Value
 	}
 }
 
-func (b *etcdDirector) reset() (uint64, error) {
-
-	// Get(key string, sort, recursive bool)
-	r, err := b.client.Get(b.etcdRootKey, true, true)
-	if err != nil {
-		return 0, err
+// responseUpdate returns the changes reported by a watch response.
+func responseUpdate(r *etcd.Response) *keyUpdate {
+	u := &keyUpdate{index: r.Node.ModifiedIndex}
+
+	// Determine if this action leaves a value behind or removes one. Deleting
+	// or expiring a directory reports no child nodes.
+	switch r.Action {
+	case "get", "set", "create", "update", "compareAndSwap":
+		nodes := make(map[string]string)
+		collectNodes(r.Node, nodes)
+		for key, value := range nodes {
+			u.events = append(u.events, keyEvent{key: key, value: value})
+		}
+	case "delete", "expire", "compareAndDelete":
+		u.events = append(u.events, keyEvent{key: r.Node.Key, deleted: true})
+	default:
+		log.WithField("action", r.Action).Info("unknown action")
 	}
 
-	// Get the lock for writing.
-	b.lock.Lock()
-
-	// Clear current domain and service values.
-	b.domains = make(map[string]*domain)
-	b.services = make(map[string]*service)
-
-	// Process the node action while holding the lock.
-	b.nodeAction(r.Node, true)
-
-	// Release the lock.
-	b.lock.Unlock()
+	return u
+}
 
-	// Return the etcd index.
-	return r.EtcdIndex, nil
+// keyNotFound reports whether or not the error is etcd's for a missing key.
+func keyNotFound(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcdKeyNotFound
 }
 
-func (b *etcdDirector) watch(index uint64) error {
+// indexCleared reports whether or not the error means the watch fell too far
+// behind the etcd history to continue.
+func indexCleared(err error) bool {
+	etcdErr, ok := err.(*etcd.EtcdError)
+	return ok && etcdErr.ErrorCode == etcdEventIndexCleared
+}
 
-	// Wait for the update after the current etcd index.
-	waitIndex := index + 1
-	for {
+func (e *etcdBackend) fetch(prefix string) (map[string]string, uint64, error) {
 
-		// Issue the watch command. This will block until a new update is
-		// available or an error occurs.
-		log.WithFields(log.Fields{"wait_index": waitIndex}).Info("watch")
-		r, err := b.client.Watch(b.etcdRootKey, waitIndex, true, nil, nil)
-		if err != nil {
-			return err
-		}
-
-		// Update the wait index to insure we don't miss any updates.
-		waitIndex = r.EtcdIndex + 1
+	// Sync the cluster. We're only issuing a warning on failure, because it's
+	// possible that we have sufficient information to read from at least one
+	// etcd instance.
+	if !e.client.SyncCluster() {
+		log.Warn("cluster sync failed")
+	}
 
-		// Process the node action while holding the lock.
-		b.lock.Lock()
+	nodes := make(map[string]string)
+	r, err := e.client.Get(prefix, true, true)
+	if err != nil {
 
-		// Determine if this action is additive or not.
-		switch r.Action {
-		case "get", "set":
-			b.nodeAction(r.Node, true)
-		case "delete", "expire":
-			b.nodeAction(r.Node, false)
-		default:
-			log.WithField("action", r.Action).Info("unknown action")
+		// A missing key is just an empty configuration.
+		if keyNotFound(err) {
+			return nodes, err.(*etcd.EtcdError).Index, nil
 		}
-
-		// Release the lock.
-		b.lock.Unlock()
+		return nil, 0, err
 	}
-}
 
-// Watch monitors etcd for any configuration updates and applies them to the
-// director. It's meant to run consistently and only log errors it encounters.
-func (b *etcdDirector) Watch() {
-	for {
+	collectNodes(r.Node, nodes)
+	return nodes, r.EtcdIndex, nil
+}
 
-		// Sync the cluster. We're only issuing a warning on failure, because it's
-		// possible that we have sufficient information to read from at least one
-		// etcd instance.
-		if !b.client.SyncCluster() {
-			log.Warn("cluster sync failed")
-		}
+func (e *etcdBackend) watch(prefix string, index uint64, updates chan<- *keyUpdate, stop <-chan struct{}) error {
 
-		// Try to get the current etcd index value and reset the groups.
-		if index, err := b.reset(); err != nil {
-			log.Error(err)
+	// Start a long-term watch from the update after the index. The client
+	// continues from the modified index of each node it reports, and closes
+	// the channel once it fails or is stopped.
+	responses := make(chan *etcd.Response)
+	stopWatch := make(chan bool)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := e.client.Watch(prefix, index+1, true, responses, stopWatch)
+		errs <- err
+	}()
 
-			// Sleep in order to not slam etcd with connection attempts.
-			time.Sleep(time.Duration(5) * time.Second)
-		} else {
+	for {
+		select {
+		case r, ok := <-responses:
+			if !ok {
+				return <-errs
+			}
 
-			// Wait for updates. In the event of an error, we go straight to another
-			// reset attempt.
-			if err := b.watch(index); err != nil {
-				log.Error(err)
+			select {
+			case updates <- responseUpdate(r):
+				continue
+			case <-stop:
 			}
+		case <-stop:
 		}
-	}
-}
 
-// Pick attempts to match a hostname/path combination with the address of a
-// server that can handle the request.
-func (b *etcdDirector) Pick(hostname, path string) (*net.TCPAddr, error) {
-
-	// Get the lock for reading and defer it's release.
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-
-	domain := b.domains[hostname]
-	if domain == nil {
-		return nil, undefinedDomainError
+		// The client blocks on sending responses, so discard any until it
+		// notices it was stopped.
+		close(stopWatch)
+		for range responses {
+		}
+		return <-errs
 	}
+}
 
-	serviceName, err := domain.pick(strings.TrimPrefix(path, "/"))
-	if err != nil {
-		return nil, err
+func (e *etcdBackend) probe(prefix string) error {
+	if _, err := e.client.Get(prefix, false, false); err != nil && !keyNotFound(err) {
+		return err
 	}
+	return nil
+}
 
-	service := b.services[serviceName]
-	if service == nil {
-		return nil, undefinedServiceError
-	}
+func (e *etcdBackend) put(key, value string) error {
+	_, err := e.client.Set(key, value, 0)
+	return err
+}
 
-	return service.pick()
+func (e *etcdBackend) resync(err error) bool {
+	return indexCleared(err)
 }
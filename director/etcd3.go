@@ -0,0 +1,334 @@
+package director
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+
+	// etcd3RequestTimeout bounds requests to the etcd v3 API other than
+	// watches, which last as long as the connection does.
+	etcd3RequestTimeout = 10 * time.Second
+)
+
+var (
+	// etcd3Stats exposes statistics for every etcd v3 director, keyed by root
+	// key.
+	etcd3Stats = expvar.NewMap("etcd3")
+)
+
+var (
+	compactedError     = errors.New("watch revision has been compacted")
+	watchClosedError   = errors.New("watch closed")
+	noEndpointsError   = errors.New("no etcd endpoints")
+	watchCanceledError = errors.New("watch canceled")
+)
+
+// The etcd v3 API is served as JSON by etcd's gRPC gateway. Keys and values
+// are base64 encoded, which encoding/json does for byte slices, and 64-bit
+// integers are strings.
+
+type etcd3Header struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcd3KeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+	Lease       int64  `json:"lease,string"`
+}
+
+type etcd3RangeRequest struct {
+	Key       []byte `json:"key"`
+	RangeEnd  []byte `json:"range_end"`
+	CountOnly bool   `json:"count_only,omitempty"`
+}
+
+type etcd3RangeResponse struct {
+	Header etcd3Header      `json:"header"`
+	Kvs    []*etcd3KeyValue `json:"kvs"`
+}
+
+type etcd3PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcd3WatchCreateRequest struct {
+	Key            []byte `json:"key"`
+	RangeEnd       []byte `json:"range_end"`
+	StartRevision  int64  `json:"start_revision,string"`
+	ProgressNotify bool   `json:"progress_notify"`
+}
+
+type etcd3WatchRequest struct {
+	CreateRequest *etcd3WatchCreateRequest `json:"create_request"`
+}
+
+type etcd3Event struct {
+
+	// Type is PUT or DELETE. The gateway may omit PUT, the default.
+	Type string         `json:"type"`
+	Kv   *etcd3KeyValue `json:"kv"`
+}
+
+type etcd3WatchResponse struct {
+	Header          etcd3Header   `json:"header"`
+	Created         bool          `json:"created"`
+	Canceled        bool          `json:"canceled"`
+	CompactRevision int64         `json:"compact_revision,string"`
+	CancelReason    string        `json:"cancel_reason"`
+	Events          []*etcd3Event `json:"events"`
+}
+
+// etcd3Error is the error the gateway responds with, both as the body of a
+// failed request and within a watch stream.
+type etcd3Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *etcd3Error) Error() string {
+	return fmt.Sprintf("etcd: %s (code %d)", e.Message, e.Code)
+}
+
+// prefixRangeEnd returns the end of the key range covering every key that
+// starts with the prefix.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// A prefix of only 0xff bytes extends to the end of the keyspace.
+	return []byte{0}
+}
+
+// etcd3Backend reads and watches keys through the etcd v3 API. The keys
+// follow the same layout as with the v2 API, under the root key treated as a
+// key prefix.
+//
+// Addresses can be attached to a lease, so that they're removed when the
+// process keeping the lease alive stops: etcd reports the expiry of a lease
+// as the deletion of its keys.
+type etcd3Backend struct {
+	endpoints []string
+	client    *http.Client
+
+	// current is the index of the endpoint that last responded, tried first
+	// by the next request.
+	current int32
+}
+
+func newEtcd3Backend(endpoints []string) *etcd3Backend {
+	return &etcd3Backend{endpoints: endpoints, client: &http.Client{}}
+}
+
+// NewEtcd3Director returns a director for the keys under the root key, with
+// its own client and watch, reading them through the etcd v3 API of the
+// given endpoints, such as http://127.0.0.1:2379. Directors of several root
+// keys in the same cluster can share both through an EtcdCluster instead.
+func NewEtcd3Director(rootKey string, endpoints []string) *etcdDirector {
+	return NewEtcd3Cluster(endpoints).Director(rootKey)
+}
+
+// keyPrefix returns the prefix of every key under the prefix key.
+func keyPrefix(prefix string) []byte {
+	return []byte(strings.TrimSuffix(prefix, "/") + "/")
+}
+
+// post sends a request to the first endpoint that responds, starting with
+// the one that last did. The caller must close the body of the response.
+func (e *etcd3Backend) post(ctx context.Context, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.endpoints) == 0 {
+		return nil, noEndpointsError
+	}
+
+	var lastErr error
+	start := int(atomic.LoadInt32(&e.current))
+	for i := range e.endpoints {
+		n := (start + i) % len(e.endpoints)
+		endpoint := e.endpoints[n]
+
+		req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(endpoint, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := e.client.Do(req)
+		if err != nil {
+
+			// Try the next endpoint, unless the request was abandoned.
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			log.WithField("endpoint", endpoint).Warn(err)
+			lastErr = err
+			continue
+		}
+
+		atomic.StoreInt32(&e.current, int32(n))
+
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+
+			etcdErr := &etcd3Error{Code: resp.StatusCode, Message: resp.Status}
+			json.NewDecoder(resp.Body).Decode(etcdErr)
+			return nil, etcdErr
+		}
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// call sends a request and decodes the response.
+func (e *etcd3Backend) call(path string, request, response interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcd3RequestTimeout)
+	defer cancel()
+
+	resp, err := e.post(ctx, path, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// eventUpdate returns the changes reported by a watch response. A response
+// without events reports the watch's progress.
+func eventUpdate(r *etcd3WatchResponse) *keyUpdate {
+	u := &keyUpdate{index: uint64(r.Header.Revision)}
+	for _, event := range r.Events {
+		if event.Kv == nil {
+			continue
+		}
+
+		switch event.Type {
+		case "", "PUT":
+			u.events = append(u.events, keyEvent{key: string(event.Kv.Key), value: string(event.Kv.Value)})
+		case "DELETE":
+			u.events = append(u.events, keyEvent{key: string(event.Kv.Key), deleted: true})
+		default:
+			log.WithField("type", event.Type).Info("unknown event type")
+		}
+	}
+	return u
+}
+
+func (e *etcd3Backend) fetch(prefix string) (map[string]string, uint64, error) {
+	key := keyPrefix(prefix)
+
+	var r etcd3RangeResponse
+	if err := e.call("/v3/kv/range", &etcd3RangeRequest{Key: key, RangeEnd: prefixRangeEnd(key)}, &r); err != nil {
+		return nil, 0, err
+	}
+
+	nodes := make(map[string]string)
+	for _, kv := range r.Kvs {
+		nodes[string(kv.Key)] = string(kv.Value)
+	}
+	return nodes, uint64(r.Header.Revision), nil
+}
+
+// watch streams changes after the revision. A watch that fell behind the
+// compacted history returns compactedError. Progress reports of the watch
+// are passed on as updates without events.
+func (e *etcd3Backend) watch(prefix string, revision uint64, updates chan<- *keyUpdate, stop <-chan struct{}) error {
+	key := keyPrefix(prefix)
+
+	// Abandon the request once the watch is stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	resp, err := e.post(ctx, "/v3/watch", &etcd3WatchRequest{CreateRequest: &etcd3WatchCreateRequest{
+		Key:            key,
+		RangeEnd:       prefixRangeEnd(key),
+		StartRevision:  int64(revision) + 1,
+		ProgressNotify: true,
+	}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result *etcd3WatchResponse `json:"result"`
+			Error  *etcd3Error         `json:"error"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				err = watchClosedError
+			}
+			return err
+		}
+
+		switch r := message.Result; {
+		case message.Error != nil:
+			return message.Error
+		case r == nil:
+		case r.CompactRevision != 0:
+			log.WithFields(log.Fields{"prefix": prefix, "compact_revision": r.CompactRevision}).Warn(compactedError)
+			return compactedError
+		case r.Canceled:
+			log.WithFields(log.Fields{"prefix": prefix, "reason": r.CancelReason}).Warn(watchCanceledError)
+			return watchCanceledError
+		default:
+			select {
+			case updates <- eventUpdate(r):
+			case <-stop:
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// probe counts the keys under the prefix key.
+func (e *etcd3Backend) probe(prefix string) error {
+	key := keyPrefix(prefix)
+
+	var r etcd3RangeResponse
+	return e.call("/v3/kv/range", &etcd3RangeRequest{Key: key, RangeEnd: prefixRangeEnd(key), CountOnly: true}, &r)
+}
+
+func (e *etcd3Backend) put(key, value string) error {
+	var r struct{}
+	return e.call("/v3/kv/put", &etcd3PutRequest{Key: []byte(key), Value: []byte(value)}, &r)
+}
+
+func (e *etcd3Backend) resync(err error) bool {
+	return err == compactedError
+}
@@ -0,0 +1,214 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd3 serves the parts of the etcd v3 JSON API the director uses, from
+// an in-memory keyspace. Watches stream the responses sent to the channel.
+type fakeEtcd3 struct {
+	lock     sync.Mutex
+	kvs      map[string]string
+	revision int64
+	watches  chan *etcd3WatchResponse
+}
+
+func newFakeEtcd3(kvs map[string]string) *fakeEtcd3 {
+	return &fakeEtcd3{kvs: kvs, revision: 10, watches: make(chan *etcd3WatchResponse)}
+}
+
+func (f *fakeEtcd3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch req.URL.Path {
+	case "/v3/kv/range":
+		var r etcd3RangeRequest
+		json.NewDecoder(req.Body).Decode(&r)
+
+		response := &etcd3RangeResponse{Header: etcd3Header{Revision: f.revision}}
+		for key, value := range f.kvs {
+			if key >= string(r.Key) && key < string(r.RangeEnd) {
+				response.Kvs = append(response.Kvs, &etcd3KeyValue{Key: []byte(key), Value: []byte(value)})
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	case "/v3/kv/put":
+		var r etcd3PutRequest
+		json.NewDecoder(req.Body).Decode(&r)
+		f.kvs[string(r.Key)] = string(r.Value)
+		f.revision++
+		json.NewEncoder(w).Encode(map[string]interface{}{"header": etcd3Header{Revision: f.revision}})
+	case "/v3/watch":
+		f.lock.Unlock()
+		defer f.lock.Lock()
+
+		encoder := json.NewEncoder(w)
+		encoder.Encode(map[string]interface{}{"result": &etcd3WatchResponse{Created: true}})
+		w.(http.Flusher).Flush()
+
+		for {
+			select {
+			case r := <-f.watches:
+				encoder.Encode(map[string]interface{}{"result": r})
+				w.(http.Flusher).Flush()
+				if r.Canceled {
+					return
+				}
+			case <-req.Context().Done():
+				return
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&etcd3Error{Code: 5, Message: "not found"})
+	}
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"/promise/": "/promise0",
+		"a\xff":     "b",
+		"\xff\xff":  "\x00",
+	} {
+		if got := string(prefixRangeEnd([]byte(prefix))); got != end {
+			t.Errorf("%q: expected %q, got %q", prefix, end, got)
+		}
+	}
+}
+
+func TestEtcd3Director(t *testing.T) {
+	fake := newFakeEtcd3(map[string]string{
+		"/promise/domains/localhost/.service": "web",
+		"/promise/services/web/1":             "127.0.0.1:8080",
+		"/other/services/web/1":               "127.0.0.1:9090",
+	})
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// The first endpoint isn't listening, so the director has to fail over.
+	c := NewEtcd3Cluster([]string{"http://127.0.0.1:1", server.URL})
+	c.BatchWindow = time.Millisecond
+	e := c.Director("promise")
+	e.WriteStatus = true
+	c.join(c.members...)
+	g := c.groups()[0]
+
+	revision, err := g.reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision != 10 {
+		t.Errorf("unexpected revision %d", revision)
+	}
+
+	if endpoint, err := e.Pick("localhost", "/"); err != nil {
+		t.Fatal(err)
+	} else if endpoint.Addr.String() != "127.0.0.1:8080" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	if status := fake.kvs["/promise/.status"]; status != `{"rejected":[]}` {
+		t.Errorf("unexpected status %q", status)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- g.watch(revision)
+	}()
+
+	// Add an address, then let it expire with its lease.
+	fake.watches <- &etcd3WatchResponse{Header: etcd3Header{Revision: 11}, Events: []*etcd3Event{
+		{Kv: &etcd3KeyValue{Key: []byte("/promise/services/web/2"), Value: []byte("127.0.0.1:8081"), Lease: 7}},
+	}}
+	waitFor(t, func() bool {
+		return len(e.table.Load().services["web"].addrs) == 2
+	})
+
+	fake.watches <- &etcd3WatchResponse{Header: etcd3Header{Revision: 12}, Events: []*etcd3Event{
+		{Type: "DELETE", Kv: &etcd3KeyValue{Key: []byte("/promise/services/web/2")}},
+	}}
+	waitFor(t, func() bool {
+		return len(e.table.Load().services["web"].addrs) == 1
+	})
+
+	// Progress reports should confirm the routing table.
+	confirmed := e.LastConfirmed()
+	fake.watches <- &etcd3WatchResponse{Header: etcd3Header{Revision: 12}}
+	waitFor(t, func() bool {
+		return e.LastConfirmed().After(confirmed)
+	})
+
+	// A compacted watch should ask for a resync.
+	fake.watches <- &etcd3WatchResponse{Canceled: true, CompactRevision: 20}
+	select {
+	case err := <-errs:
+		if err != compactedError {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not return after compaction")
+	}
+}
+
+func TestEtcdClusterJoin(t *testing.T) {
+	fake := newFakeEtcd3(map[string]string{
+		"/promise/a/domains/localhost/.service": "web",
+		"/promise/a/services/web/1":             "127.0.0.1:8080",
+		"/promise/b/domains/localhost/.service": "api",
+		"/promise/b/services/api/1":             "127.0.0.1:9090",
+	})
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	c := NewEtcd3Cluster([]string{server.URL})
+	a := c.Director("promise/a")
+	go a.Watch()
+
+	waitFor(t, func() bool {
+		_, err := a.Pick("localhost", "/")
+		return err == nil
+	})
+
+	// A director created once the cluster is watching joins the watch.
+	b := c.Director("promise/b")
+	b.Watch()
+
+	waitFor(t, func() bool {
+		endpoint, err := b.Pick("localhost", "/")
+		return err == nil && endpoint.Addr.String() == "127.0.0.1:9090"
+	})
+
+	if endpoint, err := a.Pick("localhost", "/"); err != nil || endpoint.Addr.String() != "127.0.0.1:8080" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+}
+
+func TestEtcd3DirectorError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	c := NewEtcd3Cluster([]string{server.URL})
+	c.join(c.Director("promise"))
+	if _, err := c.groups()[0].reset(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,584 @@
+package director
+
+import (
+	"errors"
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// probeFailedError is returned when etcd couldn't be reached while a watch
+// was quiet.
+var probeFailedError = errors.New("etcd didn't respond to a probe during the watch")
+
+// EtcdCluster watches a single etcd cluster on behalf of the directors of
+// several root keys, sharing one client between them. Root keys that start
+// with the same key, such as promise/a and promise/b, form a group: the
+// deepest key containing all of them is read and watched once, and the
+// changes are fanned out to each director, so that every director of the
+// group applies an update at the same time. Unrelated root keys, such as a
+// and b, are watched separately, so the cluster never watches the whole
+// keyspace. The same watch serves the etcd v2 and v3 APIs, each through its
+// own backend.
+type EtcdCluster struct {
+	backend keyBackend
+
+	// stats is the expvar map the statistics of each director are published
+	// in.
+	stats *expvar.Map
+
+	// BatchWindow is how long to wait for further updates after a watch
+	// returns before applying them together. It should be set before calling
+	// Watch.
+	BatchWindow time.Duration
+
+	// MinBackoff and MaxBackoff bound the randomized, exponentially growing
+	// delay between attempts to reach etcd after an error. They should be set
+	// before calling Watch.
+	MinBackoff, MaxBackoff time.Duration
+
+	// ConfirmInterval is the time between checks that etcd is still
+	// reachable while the watch is quiet. Each successful check confirms the
+	// routing tables, and a failed one restarts the watch. It should be set
+	// before calling Watch.
+	ConfirmInterval time.Duration
+
+	// lock guards the members, the watched members and the joined channel.
+	lock sync.Mutex
+
+	// members are the directors created by the cluster, and watched those
+	// that have been handed to its watch. Members are only watched once
+	// they've been configured.
+	members []*etcdDirector
+	watched []*etcdDirector
+
+	// joined is signaled whenever members are handed to the watch once it's
+	// running. It's nil until the watch runs.
+	joined chan struct{}
+}
+
+// NewEtcdCluster returns a cluster reading keys through the etcd v2 API of
+// the machines, such as http://127.0.0.1:4001.
+func NewEtcdCluster(machines []string) *EtcdCluster {
+	return newEtcdCluster(newEtcdBackend(machines), etcdStats)
+}
+
+// NewEtcd3Cluster returns a cluster reading keys through the etcd v3 API of
+// the endpoints, such as http://127.0.0.1:2379.
+func NewEtcd3Cluster(endpoints []string) *EtcdCluster {
+	return newEtcdCluster(newEtcd3Backend(endpoints), etcd3Stats)
+}
+
+func newEtcdCluster(backend keyBackend, stats *expvar.Map) *EtcdCluster {
+	return &EtcdCluster{
+		backend:         backend,
+		stats:           stats,
+		BatchWindow:     DefaultBatchWindow,
+		MinBackoff:      DefaultMinBackoff,
+		MaxBackoff:      DefaultMaxBackoff,
+		ConfirmInterval: DefaultConfirmInterval,
+	}
+}
+
+// Director returns a director for the root key that's kept up to date by the
+// cluster's watch, sharing its client. The same root key always returns the
+// same director. The director is watched from the next call to the Watch
+// method of either the cluster or the director, so it can be configured
+// first.
+func (c *EtcdCluster) Director(etcdRootKey string) *etcdDirector {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if member := c.member(etcdRootKey); member != nil {
+		return member
+	}
+	return c.addMember(etcdRootKey)
+}
+
+// openDirector returns the director for the root key like Director, setting
+// its options when it's created. An existing director may already be
+// watched, which reads its options without a lock, so it's only returned if
+// it has the same options.
+func (c *EtcdCluster) openDirector(etcdRootKey string, writeStatus bool, snapshotPath string) (*etcdDirector, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if member := c.member(etcdRootKey); member != nil {
+		if member.WriteStatus != writeStatus || member.SnapshotPath != snapshotPath {
+			return nil, conflictingOptionsError
+		}
+		return member, nil
+	}
+
+	member := c.addMember(etcdRootKey)
+	member.WriteStatus = writeStatus
+	member.SnapshotPath = snapshotPath
+	return member, nil
+}
+
+// member returns the director of the root key, if there is one. It expects
+// the caller to hold the lock.
+func (c *EtcdCluster) member(etcdRootKey string) *etcdDirector {
+	for _, member := range c.members {
+		if rootPrefix(member.etcdRootKey) == rootPrefix(etcdRootKey) {
+			return member
+		}
+	}
+	return nil
+}
+
+// addMember creates the director of a new root key. It expects the caller to
+// hold the lock.
+func (c *EtcdCluster) addMember(etcdRootKey string) *etcdDirector {
+	member := newEtcdDirector(etcdRootKey, c)
+	c.members = append(c.members, member)
+	return member
+}
+
+// rootPrefix returns the prefix of every key under the root key.
+func rootPrefix(rootKey string) string {
+	return "/" + strings.Trim(rootKey, "/") + "/"
+}
+
+// rootComponents returns the components of the root key's path.
+func rootComponents(rootKey string) []string {
+	return strings.Split(strings.Trim(rootKey, "/"), "/")
+}
+
+// etcdGroup is a set of members whose root keys start with the same key,
+// kept up to date by a single watch.
+type etcdGroup struct {
+	cluster *EtcdCluster
+	members []*etcdDirector
+
+	// stop is closed to end the group's watch, which closes done once it has.
+	stop, done chan struct{}
+}
+
+// groups divides the watched members by the first component of their root
+// keys, ordered by that component.
+func (c *EtcdCluster) groups() []*etcdGroup {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	byComponent := make(map[string]*etcdGroup)
+	var components []string
+	for _, member := range c.watched {
+		component := rootComponents(member.etcdRootKey)[0]
+		g, ok := byComponent[component]
+		if !ok {
+			g = &etcdGroup{cluster: c, stop: make(chan struct{}), done: make(chan struct{})}
+			byComponent[component] = g
+			components = append(components, component)
+		}
+		g.members = append(g.members, member)
+	}
+
+	sort.Strings(components)
+	groups := make([]*etcdGroup, len(components))
+	for i, component := range components {
+		groups[i] = byComponent[component]
+	}
+	return groups
+}
+
+// watchKey returns the deepest key containing the root key of every member.
+// Since the members share their first component, it's never the root of the
+// keyspace.
+func (g *etcdGroup) watchKey() string {
+	var common []string
+	for i, member := range g.members {
+		components := rootComponents(member.etcdRootKey)
+		if i == 0 {
+			common = components
+			continue
+		}
+
+		n := 0
+		for n < len(common) && n < len(components) && common[n] == components[n] {
+			n++
+		}
+		common = common[:n]
+	}
+
+	return "/" + strings.Join(common, "/")
+}
+
+// sameMembers reports whether or not both groups have the same members.
+func (g *etcdGroup) sameMembers(other *etcdGroup) bool {
+	if len(g.members) != len(other.members) {
+		return false
+	}
+	for i, member := range g.members {
+		if other.members[i] != member {
+			return false
+		}
+	}
+	return true
+}
+
+// concerns reports whether or not a change to the key can affect the member,
+// because it's under the member's root key or contains it.
+func (b *etcdDirector) concerns(key string) bool {
+	prefix := rootPrefix(b.etcdRootKey)
+	return strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, strings.TrimSuffix(key, "/")+"/")
+}
+
+// lockMembers locks every member, in order, so that changes are published to
+// all of them together.
+func (g *etcdGroup) lockMembers() {
+	for _, member := range g.members {
+		member.lock.Lock()
+	}
+}
+
+func (g *etcdGroup) unlockMembers() {
+	for _, member := range g.members {
+		member.lock.Unlock()
+	}
+}
+
+// resetNodes reconciles every member with the nodes under its root key.
+func (g *etcdGroup) resetNodes(nodes map[string]string) {
+	g.lockMembers()
+	for _, member := range g.members {
+		prefix := rootPrefix(member.etcdRootKey)
+
+		memberNodes := make(map[string]string)
+		for key, value := range nodes {
+			if strings.HasPrefix(key, prefix) {
+				memberNodes[key] = value
+			}
+		}
+
+		member.reconcile(memberNodes)
+	}
+
+	for _, member := range g.members {
+		member.commit()
+		member.confirmSnapshot()
+	}
+	g.unlockMembers()
+
+	for _, member := range g.members {
+		member.markConfirmed()
+		member.reportStatus()
+	}
+}
+
+// reset reads every key under the watch key and reconciles the members with
+// them, returning the index they were read at.
+func (g *etcdGroup) reset() (uint64, error) {
+	nodes, index, err := g.cluster.backend.fetch(g.watchKey())
+	if err != nil {
+		return 0, err
+	}
+
+	g.resetNodes(nodes)
+	return index, nil
+}
+
+// dispatch applies a batch of updates to the members they concern.
+func (g *etcdGroup) dispatch(batch []*keyUpdate) {
+	batches := make([][]*keyUpdate, len(g.members))
+
+	g.lockMembers()
+	for i, member := range g.members {
+		for _, u := range batch {
+			concerned := &keyUpdate{index: u.index}
+			for _, event := range u.events {
+				if member.concerns(event.key) {
+					member.applyEvent(event)
+					concerned.events = append(concerned.events, event)
+				}
+			}
+
+			if len(concerned.events) > 0 {
+				batches[i] = append(batches[i], concerned)
+			}
+		}
+	}
+
+	for _, member := range g.members {
+		member.commit()
+	}
+	g.unlockMembers()
+
+	// Any update shows the watch is current, for every member.
+	for i, member := range g.members {
+		member.markConfirmed()
+		if len(batches[i]) > 0 {
+			member.recordBatch(batches[i])
+			member.reportStatus()
+		}
+	}
+}
+
+// markConfirmed records that every member's routing table was just known to
+// match etcd.
+func (g *etcdGroup) markConfirmed() {
+	for _, member := range g.members {
+		member.markConfirmed()
+	}
+}
+
+// watch applies changes after the index until the watch fails or the group
+// is stopped. Updates without any changes report the watch's progress, and
+// confirm the routing tables. While the watch is quiet, etcd is probed every
+// confirm interval: a successful probe confirms the routing tables too, and
+// a failed one, or one that's still outstanding at the next interval, ends
+// the watch.
+func (g *etcdGroup) watch(index uint64) error {
+	updates := make(chan *keyUpdate)
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		log.WithFields(log.Fields{"key": g.watchKey(), "wait_index": index + 1}).Info("watch")
+		errs <- g.cluster.backend.watch(g.watchKey(), index, updates, stop)
+	}()
+
+	// stopWatch ends the watch, returning the error that ended it.
+	stopWatch := func(err error) error {
+		close(stop)
+		<-errs
+		return err
+	}
+
+	ticker := time.NewTicker(g.cluster.ConfirmInterval)
+	defer ticker.Stop()
+
+	probes := make(chan error, 1)
+	probing := false
+
+	for {
+
+		// Block until the first update of a batch is available, probing etcd in
+		// the meantime.
+		var u *keyUpdate
+		select {
+		case u = <-updates:
+			if len(u.events) == 0 {
+				g.markConfirmed()
+				continue
+			}
+		case err := <-errs:
+			return err
+		case <-g.stop:
+			return stopWatch(nil)
+		case <-ticker.C:
+			if probing {
+				return stopWatch(probeFailedError)
+			}
+
+			probing = true
+			go func() {
+				probes <- g.cluster.backend.probe(g.watchKey())
+			}()
+			continue
+		case err := <-probes:
+			probing = false
+			if err != nil {
+				return stopWatch(err)
+			}
+			g.markConfirmed()
+			continue
+		}
+
+		// Collect any further updates that arrive within the batch window, then
+		// apply them all at once. The batch is applied even if the watch fails
+		// in the meantime.
+		batch := []*keyUpdate{u}
+		timer := time.NewTimer(g.cluster.BatchWindow)
+		var err error
+	collect:
+		for {
+			select {
+			case u := <-updates:
+				if len(u.events) > 0 {
+					batch = append(batch, u)
+				}
+			case err = <-errs:
+				break collect
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		g.dispatch(batch)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// setSyncState sets the sync state of every member.
+func (g *etcdGroup) setSyncState(state SyncState) {
+	for _, member := range g.members {
+		member.setSyncState(state)
+	}
+}
+
+// stopped reports whether or not the group has been stopped.
+func (g *etcdGroup) stopped() bool {
+	select {
+	case <-g.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run keeps the members up to date until the group is stopped, then closes
+// the done channel.
+func (g *etcdGroup) run() {
+	defer close(g.done)
+
+	delays := &backoff{min: g.cluster.MinBackoff, max: g.cluster.MaxBackoff}
+	for !g.stopped() {
+
+		// Try to get the current index and reset the members.
+		index, err := g.reset()
+		if err == nil {
+
+			// Wait for updates.
+			for _, member := range g.members {
+				member.confirm()
+			}
+			g.setSyncState(SyncCurrent)
+			delays.reset()
+			err = g.watch(index)
+			if g.stopped() {
+				return
+			}
+
+			// Falling behind the history isn't a connection problem, so we go
+			// straight to another reset attempt.
+			if g.cluster.backend.resync(err) {
+				log.WithField("key", g.watchKey()).Warn(err)
+				g.setSyncState(SyncResyncing)
+				continue
+			}
+		}
+
+		// Back off in order to not slam etcd with connection attempts. The
+		// jitter keeps a fleet of instances from retrying in lockstep.
+		delay := delays.next()
+		log.WithFields(log.Fields{"key": g.watchKey(), "retry_in": delay}).Error(err)
+		for _, member := range g.members {
+			member.stats.Add("errors", 1)
+		}
+		g.setSyncState(SyncBackoff)
+
+		select {
+		case <-time.After(delay):
+		case <-g.stop:
+		}
+	}
+}
+
+// join hands members to the watch. If the watch is already running, it's
+// signaled to start watching them. Otherwise, join reports that the caller
+// should run it.
+func (c *EtcdCluster) join(members ...*etcdDirector) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+join:
+	for _, member := range members {
+		for _, watched := range c.watched {
+			if watched == member {
+				continue join
+			}
+		}
+		c.watched = append(c.watched, member)
+	}
+
+	if c.joined == nil {
+		c.joined = make(chan struct{}, 1)
+		return true
+	}
+
+	select {
+	case c.joined <- struct{}{}:
+	default:
+	}
+	return false
+}
+
+// Watch monitors etcd for any configuration updates and applies them to the
+// directors created so far. It's meant to run consistently and only log
+// errors it encounters. Only the first call to the Watch method of the
+// cluster or any of its directors runs the watch: later calls hand their
+// directors to it and return immediately.
+//
+// Adding a director to a group restarts the group's watch, so that it covers
+// the new root key, without interrupting the other groups.
+func (c *EtcdCluster) Watch() {
+	c.lock.Lock()
+	members := append([]*etcdDirector(nil), c.members...)
+	c.lock.Unlock()
+
+	c.watch(members...)
+}
+
+// watch hands the members to the watch, and runs it unless it's already
+// running.
+func (c *EtcdCluster) watch(members ...*etcdDirector) {
+	if !c.join(members...) {
+		return
+	}
+
+	// Running groups are keyed by the first component of their root keys.
+	running := make(map[string]*etcdGroup)
+	watched := make(map[*etcdDirector]bool)
+	for {
+
+		// Directors are usually opened together, so give the others a moment
+		// to join rather than restarting their groups for each of them.
+		time.Sleep(c.BatchWindow)
+		select {
+		case <-c.joined:
+		default:
+		}
+
+		groups := make(map[string]*etcdGroup)
+		for _, g := range c.groups() {
+			groups[rootComponents(g.watchKey())[0]] = g
+		}
+
+		for component, current := range running {
+			if g, ok := groups[component]; ok && g.sameMembers(current) {
+				groups[component] = current
+				continue
+			}
+
+			close(current.stop)
+			<-current.done
+			delete(running, component)
+		}
+
+		for component, g := range groups {
+			if running[component] == g {
+				continue
+			}
+
+			// New members serve their snapshot until their first reset.
+			for _, member := range g.members {
+				if !watched[member] {
+					member.confirmedAt(member.loadSnapshot())
+					watched[member] = true
+				}
+			}
+
+			running[component] = g
+			go g.run()
+		}
+
+		<-c.joined
+	}
+}
@@ -0,0 +1,109 @@
+package director
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func TestEtcdClusterGroups(t *testing.T) {
+	for members, keys := range map[[2]string]string{
+		{"promise/a", "promise/b"}:   "/promise",
+		{"/promise/a", "promise/a/"}: "/promise/a",
+		{"promise/a", "promise/ab"}:  "/promise",
+
+		// Unrelated root keys are watched separately, rather than together
+		// from the root of the keyspace.
+		{"a", "b"}:         "/a,/b",
+		{"b/c", "a/b/c"}:   "/a/b/c,/b/c",
+		{"promise", "a/b"}: "/a/b,/promise",
+	} {
+		c := NewEtcdCluster([]string{})
+		c.Director(members[0])
+		c.Director(members[1])
+
+		c.join(c.members...)
+
+		var watchKeys []string
+		for _, g := range c.groups() {
+			watchKeys = append(watchKeys, g.watchKey())
+		}
+		if strings.Join(watchKeys, ",") != keys {
+			t.Errorf("%q: expected watch keys %q, got %q", members, keys, watchKeys)
+		}
+	}
+}
+
+func TestEtcdClusterDispatch(t *testing.T) {
+	c := NewEtcdCluster([]string{})
+	a := c.Director("promise/a")
+	b := c.Director("promise/b")
+	c.join(c.members...)
+	g := c.groups()[0]
+
+	if c.Director("promise/a") != a {
+		t.Error("the same root key returned a different director")
+	}
+
+	g.dispatch(responseUpdates(
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/a/domains/localhost/.service", Value: "web"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/a/services/web/1", Value: "127.0.0.1:8080"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/b/domains/localhost/.service", Value: "api"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/b/services/api/1", Value: "127.0.0.1:9090"}},
+
+		// Neither director should see keys outside of its root key, including
+		// those of a root key it's a prefix of.
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/ab/services/api/.protocol", Value: "bogus"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/other", Value: "bogus"}},
+	))
+
+	if endpoint, err := a.Pick("localhost", "/"); err != nil || endpoint.Addr.String() != "127.0.0.1:8080" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	if endpoint, err := b.Pick("localhost", "/"); err != nil || endpoint.Addr.String() != "127.0.0.1:9090" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	if len(a.Rejections()) != 0 || len(b.Rejections()) != 0 {
+		t.Errorf("unexpected rejections %v, %v", a.Rejections(), b.Rejections())
+	}
+
+	// Deleting a common ancestor should clear both directors.
+	g.dispatch(responseUpdates(&etcd.Response{Action: "delete", Node: &etcd.Node{Key: "/promise", Dir: true}}))
+
+	if _, err := a.Pick("localhost", "/"); err == nil {
+		t.Error("director a still routes after its root key was deleted")
+	}
+
+	if _, err := b.Pick("localhost", "/"); err == nil {
+		t.Error("director b still routes after its root key was deleted")
+	}
+}
+
+func TestEtcdClusterResetNodes(t *testing.T) {
+	c := NewEtcdCluster([]string{})
+	a := c.Director("promise/a")
+	b := c.Director("promise/b")
+	c.join(c.members...)
+	g := c.groups()[0]
+
+	g.resetNodes(map[string]string{
+		"/promise/a/domains/localhost/.service":  "web",
+		"/promise/a/services/web/1":              "127.0.0.1:8080",
+		"/promise/ab/domains/localhost/.service": "bogus",
+	})
+
+	if endpoint, err := a.Pick("localhost", "/"); err != nil || endpoint.Addr.String() != "127.0.0.1:8080" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	if _, err := b.Pick("localhost", "/"); err == nil {
+		t.Error("director b routes keys outside of its root key")
+	}
+
+	if len(a.Rejections()) != 0 || len(b.Rejections()) != 0 {
+		t.Errorf("unexpected rejections %v, %v", a.Rejections(), b.Rejections())
+	}
+}
@@ -2,23 +2,44 @@ package director
 
 import (
 	"net"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
 )
 
+// responseUpdates returns the changes reported by etcd v2 watch responses.
+func responseUpdates(responses ...*etcd.Response) []*keyUpdate {
+	batch := make([]*keyUpdate, len(responses))
+	for i, r := range responses {
+		batch[i] = responseUpdate(r)
+	}
+	return batch
+}
+
+// applyResponses applies etcd v2 watch responses to the director as a single
+// batch.
+func applyResponses(e *etcdDirector, responses ...*etcd.Response) {
+	e.applyBatch(responseUpdates(responses...))
+}
+
 func BenchmarkEtcdDirectorPickSingleMatch(b *testing.B) {
 
 	e := NewEtcdDirector("/promise", []string{})
 
-	e.domains["localhost"] = newDomain()
-	e.domains["localhost"].setServicePrefix("/", "service")
-	e.services["service"] = newService()
+	t := newTable()
+	t.domains["localhost"] = newDomain()
+	t.domains["localhost"].setServicePrefix("/", "service")
+	t.services["service"] = newService()
 
 	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:4001")
 	if err != nil {
 		b.Fatal(err)
 	}
 
-	e.services["service"].setAddr("1", addr)
+	t.services["service"].setAddr("1", addr)
+	e.table.Store(t)
 
 	b.ResetTimer()
 
@@ -27,3 +48,304 @@ func BenchmarkEtcdDirectorPickSingleMatch(b *testing.B) {
 	}
 
 }
+
+func TestEtcdDirectorApply(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+
+	responses := []*etcd.Response{
+		{Action: "create", Node: &etcd.Node{Key: "/promise/domains/localhost/.service", Value: "web"}},
+		{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "127.0.0.1:8080"}},
+		{Action: "compareAndSwap", Node: &etcd.Node{Key: "/promise/services/web/2", Value: "127.0.0.1:8081"}},
+		{Action: "update", Node: &etcd.Node{Key: "/promise/services/web/.protocol", Value: "h2c"}},
+	}
+	for _, r := range responses {
+		applyResponses(e, r)
+	}
+
+	endpoint, err := e.Pick("localhost", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint.Service != "web" || endpoint.Config.Protocol != ProtocolH2C {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	// Updating a value should replace the old one rather than add to it.
+	applyResponses(e, &etcd.Response{Action: "update", Node: &etcd.Node{Key: "/promise/services/web/2", Value: "127.0.0.1:8082"}})
+	if n := len(e.table.Load().services["web"].addrs); n != 2 {
+		t.Errorf("expected 2 addrs, got %d", n)
+	}
+
+	applyResponses(e, &etcd.Response{Action: "compareAndDelete", Node: &etcd.Node{Key: "/promise/services/web/.protocol"}})
+	if e.table.Load().services["web"].config.Protocol != ProtocolHTTP {
+		t.Error("protocol setting was not removed")
+	}
+
+	// Deleting or expiring a directory reports no child nodes.
+	applyResponses(e, &etcd.Response{Action: "expire", Node: &etcd.Node{Key: "/promise/services/web", Dir: true}})
+	if _, err := e.PickService("web"); err != undefinedServiceError {
+		t.Errorf("expected %v, got %v", undefinedServiceError, err)
+	}
+
+	applyResponses(e, &etcd.Response{Action: "delete", Node: &etcd.Node{Key: "/promise/domains/localhost", Dir: true}})
+	if _, err := e.Pick("localhost", "/"); err != undefinedDomainError {
+		t.Errorf("expected %v, got %v", undefinedDomainError, err)
+	}
+
+	if len(e.nodes) != 0 {
+		t.Errorf("expected an empty index, got %v", e.nodes)
+	}
+}
+
+func TestEtcdDirectorReconcile(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+
+	e.reconcile(map[string]string{
+		"/promise/domains/localhost/.service":   "web",
+		"/promise/domains/example.com/.service": "web",
+		"/promise/services/web/1":               "127.0.0.1:8080",
+		"/promise/services/web/2":               "127.0.0.1:8081",
+	})
+
+	e.publish()
+
+	web := e.table.Load().services["web"]
+	web.pick()
+
+	e.reconcile(map[string]string{
+		"/promise/domains/localhost/.service": "web",
+		"/promise/services/web/1":             "127.0.0.1:8080",
+		"/promise/services/web/2":             "127.0.0.1:8082",
+		"/promise/services/web/3":             "127.0.0.1:8083",
+	})
+
+	e.publish()
+
+	// The published table must not have been changed in place.
+	if n := len(web.addrs); n != 2 {
+		t.Errorf("previous table was modified, found %d addrs", n)
+	}
+
+	// The updated service should have kept its position.
+	previous := web
+	web = e.table.Load().services["web"]
+	if web.index != previous.index || *web.index != 1 {
+		t.Error("service state was not preserved")
+	}
+
+	if n := len(web.addrs); n != 3 {
+		t.Errorf("expected 3 addrs, got %d", n)
+	}
+
+	if web.addrs["2"].String() != "127.0.0.1:8082" {
+		t.Errorf("changed addr was not applied: %s", web.addrs["2"])
+	}
+
+	if _, ok := e.table.Load().domains["example.com"]; ok {
+		t.Error("removed domain is still present")
+	}
+}
+
+func TestEtcdDirectorCommit(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+
+	applyResponses(e, &etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/.commit", Value: "1"}})
+	applyResponses(e, &etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/.service", Value: "web"}})
+
+	// Staged changes must not be visible until the commit key advances.
+	if _, err := e.Pick("localhost", "/"); err != undefinedDomainError {
+		t.Errorf("expected %v, got %v", undefinedDomainError, err)
+	}
+
+	applyResponses(e, &etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "127.0.0.1:8080"}})
+	applyResponses(e, &etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/.commit", Value: "2"}})
+
+	if _, err := e.Pick("localhost", "/"); err != nil {
+		t.Error(err)
+	}
+
+	// Without a commit key, changes are published as they arrive.
+	applyResponses(e, &etcd.Response{Action: "delete", Node: &etcd.Node{Key: "/promise/.commit"}})
+	applyResponses(e, &etcd.Response{Action: "delete", Node: &etcd.Node{Key: "/promise/services/web/1"}})
+
+	if _, err := e.Pick("localhost", "/"); err != undefinedServiceError {
+		t.Errorf("expected %v, got %v", undefinedServiceError, err)
+	}
+}
+
+func TestEtcdDirectorCommitBatch(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/.commit", Value: "1"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/.service", Value: "web"}},
+	)
+
+	// A batch can hold a staged change, the commit releasing it, and a change
+	// staged for the next commit, which must stay unpublished.
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "127.0.0.1:8080"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/.commit", Value: "2"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/x/.service", Value: "c"}},
+	)
+
+	if endpoint, err := e.Pick("localhost", "/x"); err != nil || endpoint.Service != "web" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/c/1", Value: "127.0.0.1:8081"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/.commit", Value: "3"}},
+	)
+
+	if endpoint, err := e.Pick("localhost", "/x"); err != nil || endpoint.Service != "c" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+}
+
+func TestEtcdDirectorApplyBatch(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+	previous := e.table.Load()
+
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/.service", Value: "web"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "127.0.0.1:8080"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/2", Value: "127.0.0.1:8081"}},
+	)
+
+	// The whole batch is published as a single new table.
+	if len(previous.services) != 0 {
+		t.Error("previous table was modified")
+	}
+
+	if n := len(e.table.Load().services["web"].addrs); n != 2 {
+		t.Errorf("expected 2 addrs, got %d", n)
+	}
+
+	if n := e.lastBatchSize.Value(); n != 3 {
+		t.Errorf("expected a batch size of 3, got %d", n)
+	}
+}
+
+func TestIndexCleared(t *testing.T) {
+	if !indexCleared(&etcd.EtcdError{ErrorCode: etcdEventIndexCleared}) {
+		t.Error("index cleared error was not recognized")
+	}
+
+	if indexCleared(&etcd.EtcdError{ErrorCode: etcd.ErrCodeEtcdNotReachable}) {
+		t.Error("connection error was mistaken for a cleared index")
+	}
+}
+
+func TestEtcdDirectorSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promise.json")
+
+	e := NewEtcdDirector("promise", []string{})
+	e.SnapshotPath = path
+	applyResponses(e, &etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/.service", Value: "web"}})
+	applyResponses(e, &etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "127.0.0.1:8080"}})
+
+	// A new director should serve the saved configuration, marked as stale.
+	restarted := NewEtcdDirector("promise", []string{})
+	restarted.SnapshotPath = path
+	restarted.confirmedAt(restarted.loadSnapshot())
+
+	if _, err := restarted.Pick("localhost", "/"); err != nil {
+		t.Error(err)
+	}
+
+	if !restarted.Stale() {
+		t.Error("snapshot was not marked as stale")
+	}
+
+	// The snapshot was confirmed when it was saved.
+	if confirmed := restarted.LastConfirmed(); confirmed.IsZero() || time.Since(confirmed) > time.Minute {
+		t.Errorf("unexpected confirmation time %s", confirmed)
+	}
+}
+
+func TestEtcdDirectorLastConfirmed(t *testing.T) {
+	c := NewEtcdCluster([]string{})
+	e := c.Director("promise")
+	c.join(c.members...)
+	g := c.groups()[0]
+
+	if !e.LastConfirmed().IsZero() {
+		t.Error("a new director should never have been confirmed")
+	}
+
+	// Reading the keys confirms the routing table, but the sync state alone
+	// doesn't.
+	g.resetNodes(map[string]string{})
+	confirmed := e.LastConfirmed()
+	if confirmed.IsZero() {
+		t.Fatal("reading the keys did not record a time")
+	}
+
+	e.setSyncState(SyncCurrent)
+	e.setSyncState(SyncBackoff)
+	if !e.LastConfirmed().Equal(confirmed) {
+		t.Error("the confirmed time advanced without hearing from etcd")
+	}
+
+	// So does any watch response.
+	g.dispatch(responseUpdates(&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/elsewhere", Value: "b"}}))
+	if !e.LastConfirmed().After(confirmed) {
+		t.Error("a watch response did not confirm the routing table")
+	}
+}
+
+func TestEtcdDirectorRejections(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "nowhere"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/.protocol", Value: "gopher"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/.color", Value: "blue"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/elsewhere/a/b", Value: "c"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/shallow", Value: "d"}},
+	)
+
+	rejections := e.Rejections()
+	if len(rejections) != 5 {
+		t.Fatalf("expected 5 rejections, got %d", len(rejections))
+	}
+
+	if rejections[0].Key != "/promise/domains/localhost/.color" || rejections[0].Reason != unknownCommandError.Error() {
+		t.Errorf("unexpected rejection %+v", rejections[0])
+	}
+
+	if _, err := e.PickService("web"); err != undefinedServiceError {
+		t.Errorf("expected %v, got %v", undefinedServiceError, err)
+	}
+
+	// Fixing or removing a key clears its rejection.
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/web/1", Value: "127.0.0.1:8080"}},
+		&etcd.Response{Action: "delete", Node: &etcd.Node{Key: "/promise/elsewhere", Dir: true}},
+	)
+
+	if n := len(e.Rejections()); n != 3 {
+		t.Errorf("expected 3 rejections, got %d", n)
+	}
+}
+
+func TestEtcdDirectorNestedPrefix(t *testing.T) {
+	e := NewEtcdDirector("promise", []string{})
+
+	applyResponses(e,
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/.service", Value: "root"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/domains/localhost/a/b/.service", Value: "nested"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/root/1", Value: "127.0.0.1:8080"}},
+		&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/promise/services/nested/1", Value: "127.0.0.1:8081"}},
+	)
+
+	for path, service := range map[string]string{"/a/b/c": "nested", "/a/c": "root", "/": "root"} {
+		endpoint, err := e.Pick("localhost", path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if endpoint.Service != service {
+			t.Errorf("%s: expected %s, got %s", path, service, endpoint.Service)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package director
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+
+	// DefaultPollInterval is the default time between checks of a routing
+	// file for changes.
+	DefaultPollInterval = time.Second
+
+	// modTimeGranularity is the longest time a file's modification time may
+	// be rounded by. A file modified this recently before it was loaded may
+	// change again without its modification time changing.
+	modTimeGranularity = 2 * time.Second
+)
+
+var (
+	invalidSettingValueError = errors.New("setting value must be a string, number or boolean")
+)
+
+// routesFile is a routing file. It expresses the same model as the etcd keys,
+// with domains mapping path prefixes to service names and services holding
+// named addresses and settings. Files are JSON:
+//
+//	{
+//	  "domains": {
+//	    "example.com": {"": "web", "api/": "api"}
+//	  },
+//	  "services": {
+//	    "web": {
+//	      "addrs": {"1": "127.0.0.1:8080", "2": "unix:///run/web.sock"},
+//	      "settings": {"protocol": "h2c", "timeout": "30s"}
+//	    }
+//	  }
+//	}
+//
+// or, with a .yaml or .yml extension, the same structure as YAML block
+// mappings:
+//
+//	domains:
+//	  example.com:
+//	    "": web
+//	    api/: api
+//	services:
+//	  web:
+//	    addrs:
+//	      "1": 127.0.0.1:8080
+//	    settings:
+//	      protocol: h2c
+//
+// Settings use the same names as the keys of etcd services, without the
+// leading dot. Other formats, such as TOML, aren't supported.
+type routesFile struct {
+	Domains  map[string]map[string]string `json:"domains"`
+	Services map[string]*routesService    `json:"services"`
+}
+
+type routesService struct {
+	Addrs    map[string]string       `json:"addrs"`
+	Settings map[string]settingValue `json:"settings"`
+}
+
+// settingValue is a setting written as a JSON string, number or boolean, so
+// that files can say "max_idle_conns": 10 rather than "10".
+type settingValue string
+
+func (v *settingValue) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = settingValue(s)
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value.(type) {
+	case float64, bool:
+		*v = settingValue(data)
+		return nil
+	}
+	return invalidSettingValueError
+}
+
+// nodes returns the configuration keys under the root key the file is
+// equivalent to.
+func (r *routesFile) nodes(rootKey string) map[string]string {
+	nodes := make(map[string]string)
+	for dn, prefixes := range r.Domains {
+		for prefix, service := range prefixes {
+			nodes[domainKey(rootKey, dn, prefix)] = service
+		}
+	}
+
+	for sn, s := range r.Services {
+		if s == nil {
+			continue
+		}
+
+		for name, addr := range s.Addrs {
+			nodes[serviceKey(rootKey, sn, name)] = addr
+		}
+
+		for key, value := range s.Settings {
+			nodes[serviceKey(rootKey, sn, "."+key)] = string(value)
+		}
+	}
+
+	return nodes
+}
+
+// fileDirector routes according to a JSON or YAML routing file, reloading it
+// whenever it changes. Entries that can't be applied are reported as rejected keys
+// under the path of the file, such as /etc/promise.json/services/web/.timeout.
+type fileDirector struct {
+	*keyState
+	syncTracker
+
+	path string
+
+	// PollInterval is the time between checks of the file for changes. It
+	// should be set before calling Watch.
+	PollInterval time.Duration
+
+	// modTime, size and sum identify the version of the file last loaded,
+	// read at loadedAt, and err is the result of loading it. They're only
+	// accessed by Watch.
+	modTime  time.Time
+	size     int64
+	sum      [sha256.Size]byte
+	loadedAt time.Time
+	err      error
+}
+
+func NewFileDirector(path string) *fileDirector {
+	return &fileDirector{
+		keyState:     newKeyState(path),
+		syncTracker:  syncTracker{name: path},
+		path:         path,
+		PollInterval: DefaultPollInterval,
+	}
+}
+
+// isYAML reports whether or not the file's extension marks it as YAML.
+func (f *fileDirector) isYAML() bool {
+	switch strings.ToLower(filepath.Ext(f.path)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// load parses the contents of the file and applies the differences to the
+// routing table. An invalid file leaves the routing table as it was.
+func (f *fileDirector) load(data []byte) error {
+
+	// YAML is converted to JSON, so both are decoded the same way.
+	if f.isYAML() {
+		value, err := parseYAML(data)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+
+	var routes routesFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&routes); err != nil {
+		return err
+	}
+
+	nodes := routes.nodes(f.path)
+
+	f.lock.Lock()
+	f.reconcile(nodes)
+	f.commit()
+	f.lock.Unlock()
+
+	log.WithFields(log.Fields{"path": f.path, "keys": len(nodes)}).Info("loaded routing file")
+	return nil
+}
+
+// check loads the file if its contents changed since it was last loaded, and
+// returns the result of the last load. The file is only read again if its
+// modification time or size changed, or if it was modified so shortly before
+// it was last read that it could have changed within the same modification
+// time. Its contents are then compared by hash.
+func (f *fileDirector) check() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size && f.loadedAt.Sub(f.modTime) > modTimeGranularity {
+		return f.err
+	}
+
+	loadedAt := time.Now()
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.modTime, f.size, f.loadedAt = info.ModTime(), info.Size(), loadedAt
+	if sum := sha256.Sum256(data); sum != f.sum {
+		f.sum = sum
+		f.err = f.load(data)
+	}
+	return f.err
+}
+
+// Watch polls the file for changes and applies them to the director. It's
+// meant to run consistently and only log errors it encounters.
+func (f *fileDirector) Watch() {
+	var lastErr error
+	for {
+		err := f.check()
+		if err == nil {
+			f.markConfirmed()
+			f.setSyncState(SyncCurrent)
+		} else {
+			f.setSyncState(SyncBackoff)
+
+			// Only log an error once, rather than on every check.
+			if lastErr == nil || err.Error() != lastErr.Error() {
+				log.WithField("path", f.path).Error(err)
+			}
+		}
+		lastErr = err
+
+		time.Sleep(f.PollInterval)
+	}
+}
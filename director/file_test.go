@@ -0,0 +1,185 @@
+package director
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeRoutes(t *testing.T, path, routes string) {
+	if err := os.WriteFile(path, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileDirector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promise.json")
+	writeRoutes(t, path, `{
+		"domains": {"localhost": {"": "web", "api/": "api"}},
+		"services": {
+			"web": {"addrs": {"1": "127.0.0.1:8080"}, "settings": {"protocol": "h2c", "max_idle_conns": 10}},
+			"api": {"addrs": {"1": "unix:///run/api.sock"}}
+		}
+	}`)
+
+	f := NewFileDirector(path)
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := f.Pick("localhost", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint.Service != "web" || endpoint.Config.Protocol != ProtocolH2C || endpoint.Config.MaxIdleConns != 10 {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	if endpoint, err := f.Pick("localhost", "/api/users"); err != nil {
+		t.Error(err)
+	} else if endpoint.Service != "api" || endpoint.Prefix != "api/" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	// Changing the file should replace the routes.
+	writeRoutes(t, path, `{
+		"domains": {"localhost": {"": "api"}},
+		"services": {"api": {"addrs": {"1": "127.0.0.1:8081"}}}
+	}`)
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint, err := f.Pick("localhost", "/"); err != nil {
+		t.Error(err)
+	} else if endpoint.Service != "api" || endpoint.Addr.String() != "127.0.0.1:8081" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	if _, err := f.PickService("web"); err != undefinedServiceError {
+		t.Errorf("removed service is still defined: %v", err)
+	}
+
+	// An invalid file should leave the routes as they were.
+	writeRoutes(t, path, `{"domains": {"localhost": {"": "web"}}, "typo": {}}`)
+	if err := f.check(); err == nil {
+		t.Error("invalid file was accepted")
+	}
+
+	if endpoint, err := f.Pick("localhost", "/"); err != nil || endpoint.Service != "api" {
+		t.Errorf("routes changed after an invalid file: %+v, %v", endpoint, err)
+	}
+}
+
+func TestFileDirectorRejections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promise.json")
+	writeRoutes(t, path, `{
+		"domains": {"localhost": {"": "web"}},
+		"services": {"web": {"addrs": {"1": "127.0.0.1:8080"}, "settings": {"protocol": "gopher"}}}
+	}`)
+
+	f := NewFileDirector(path)
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	rejections := f.Rejections()
+	if len(rejections) != 1 || rejections[0].Key != path+"/services/web/.protocol" {
+		t.Errorf("unexpected rejections %+v", rejections)
+	}
+
+	if _, err := f.Pick("localhost", "/"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileDirectorYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promise.yaml")
+	writeRoutes(t, path, `---
+# Routes for local development.
+domains:
+  localhost:
+    "": web # everything else
+    api/: api
+services:
+  web:
+    addrs:
+      "1": 127.0.0.1:8080
+    settings:
+      protocol: h2c
+      max_idle_conns: 10
+  api:
+    addrs:
+      '1': 'unix:///run/api.sock'
+`)
+
+	f := NewFileDirector(path)
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint, err := f.Pick("localhost", "/"); err != nil {
+		t.Error(err)
+	} else if endpoint.Service != "web" || endpoint.Config.Protocol != ProtocolH2C || endpoint.Config.MaxIdleConns != 10 {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	if endpoint, err := f.Pick("localhost", "/api/users"); err != nil {
+		t.Error(err)
+	} else if endpoint.Addr.String() != "/run/api.sock" {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	// Unknown fields are rejected as they are in JSON.
+	writeRoutes(t, path, "domains: {}\ntypo: {}\n")
+	if err := f.check(); err == nil {
+		t.Error("invalid file was accepted")
+	}
+}
+
+func TestFileDirectorSameModTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promise.json")
+	writeRoutes(t, path, `{"domains": {"localhost": {"": "web"}}}`)
+
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFileDirector(path)
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change of the same size that keeps the modification time is only
+	// noticed by its contents, while the file was loaded recently enough
+	// after being modified. Otherwise, the file isn't read again.
+	writeRoutes(t, path, `{"domains": {"localhost": {"": "api"}}}`)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	f.loadedAt = modTime
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if service := f.Table().Domains["localhost"][""]; service != "api" {
+		t.Errorf("change was not noticed, routing to %q", service)
+	}
+
+	writeRoutes(t, path, `{"domains": {"localhost": {"": "web"}}}`)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if service := f.Table().Domains["localhost"][""]; service != "api" {
+		t.Errorf("file was read again, routing to %q", service)
+	}
+}
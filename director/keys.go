@@ -0,0 +1,154 @@
+package director
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Configuration keys are read relative to a root key, such as /promise, and
+// follow this grammar:
+//
+//	key     = ".commit" | ".status"
+//	        | "domains/" domain *( "/" segment ) "/.service"
+//	        | "services/" service "/" ( addr | "." setting )
+//
+// A domain key routes the path prefix made of its segments, joined by
+// slashes, to the service named by its value. Without any segments it's the
+// root prefix, which matches every path of the domain:
+//
+//	domains/example.com/.service            prefix ""
+//	domains/example.com/api/.service        prefix "api"
+//	domains/example.com/api/v2/.service     prefix "api/v2"
+//
+// Prefixes are matched against request paths without the leading slash, as
+// plain string prefixes, so "api" matches both /api/users and /apis. Since
+// etcd collapses repeated slashes in keys, segments are unescaped like URL
+// path segments: a literal slash within a segment, including a trailing one,
+// is written as %2F. A segment starting with a dot is reserved for commands,
+// so a literal leading dot is written as %2E:
+//
+//	domains/example.com/api%2F/.service     prefix "api/"
+//	domains/example.com/%2Ewell-known/.service  prefix ".well-known"
+//
+// A service key holds either a named address, such as 127.0.0.1:8080 or
+// unix:///run/app.sock, or a setting when its last component starts with a
+// dot, such as services/web/.protocol.
+//
+// Domain, service, address and setting names are used verbatim.
+
+const (
+	reservedKind = "reserved"
+
+	serviceCommand = ".service"
+)
+
+var (
+	outsideRootError   = errors.New("key is outside of the root key")
+	emptySegmentError  = errors.New("key has an empty component")
+	invalidEscapeError = errors.New("key has an invalid escape sequence")
+)
+
+// parsedKey is a configuration key broken down according to the grammar.
+type parsedKey struct {
+
+	// kind is domainsKind, servicesKind or reservedKind.
+	kind string
+
+	// name is the domain, service or reserved key name.
+	name string
+
+	// prefix is the path prefix routed by a domain key.
+	prefix string
+
+	// detail is the address name or, starting with a dot, the setting of a
+	// service key.
+	detail string
+}
+
+// parseKey parses a full etcd key under the root key.
+func parseKey(rootKey, key string) (*parsedKey, error) {
+	rootPrefix := "/" + strings.Trim(rootKey, "/") + "/"
+	if !strings.HasPrefix(key, rootPrefix) {
+		return nil, outsideRootError
+	}
+
+	components := strings.Split(strings.TrimPrefix(key, rootPrefix), "/")
+	for _, component := range components {
+		if component == "" {
+			return nil, emptySegmentError
+		}
+	}
+
+	// Reserved keys sit directly under the root key.
+	if len(components) == 1 {
+		switch components[0] {
+		case commitKey, statusKey:
+			return &parsedKey{kind: reservedKind, name: components[0]}, nil
+		}
+		return nil, nodeComponentsError
+	}
+
+	if len(components) < 3 {
+		return nil, nodeComponentsError
+	}
+
+	parsed := &parsedKey{kind: components[0], name: components[1]}
+	switch parsed.kind {
+	case domainsKind:
+		if components[len(components)-1] != serviceCommand {
+			return nil, unknownCommandError
+		}
+
+		segments := components[2 : len(components)-1]
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ".") {
+				return nil, unknownCommandError
+			}
+
+			unescaped, err := url.PathUnescape(segment)
+			if err != nil {
+				return nil, invalidEscapeError
+			}
+			segments[i] = unescaped
+		}
+
+		parsed.prefix = strings.Join(segments, "/")
+	case servicesKind:
+		if len(components) != 3 {
+			return nil, nodeComponentsError
+		}
+
+		parsed.detail = components[2]
+	default:
+		return nil, unknownKindError
+	}
+
+	return parsed, nil
+}
+
+// domainsKey returns the full key of the directory holding every prefix of
+// the domain.
+func domainsKey(rootKey, dn string) string {
+	return "/" + strings.Trim(rootKey, "/") + "/" + domainsKind + "/" + dn
+}
+
+// domainKey returns the full key routing the prefix of the domain, escaping
+// the prefix so that parseKey returns it unchanged.
+func domainKey(rootKey, dn, prefix string) string {
+	key := domainsKey(rootKey, dn)
+	if prefix != "" {
+		segment := url.PathEscape(prefix)
+		if strings.HasPrefix(segment, ".") {
+			segment = "%2E" + segment[1:]
+		}
+		key += "/" + segment
+	}
+	return key + "/" + serviceCommand
+}
+
+// serviceKey returns the full key of an address or, starting with a dot, a
+// setting of the service.
+func serviceKey(rootKey, sn, detail string) string {
+	return "/" + strings.Trim(rootKey, "/") + "/" + servicesKind + "/" + sn + "/" + detail
+}
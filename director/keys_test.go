@@ -0,0 +1,70 @@
+package director
+
+import (
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected *parsedKey
+		err      error
+	}{
+		{"/promise/domains/example.com/.service", &parsedKey{kind: domainsKind, name: "example.com"}, nil},
+		{"/promise/domains/example.com/api/.service", &parsedKey{kind: domainsKind, name: "example.com", prefix: "api"}, nil},
+		{"/promise/domains/example.com/a/b/.service", &parsedKey{kind: domainsKind, name: "example.com", prefix: "a/b"}, nil},
+		{"/promise/domains/example.com/a/b/c/.service", &parsedKey{kind: domainsKind, name: "example.com", prefix: "a/b/c"}, nil},
+		{"/promise/domains/example.com/api%2F/.service", &parsedKey{kind: domainsKind, name: "example.com", prefix: "api/"}, nil},
+		{"/promise/domains/example.com/%2Ewell-known/.service", &parsedKey{kind: domainsKind, name: "example.com", prefix: ".well-known"}, nil},
+		{"/promise/domains/example.com:8080/.service", &parsedKey{kind: domainsKind, name: "example.com:8080"}, nil},
+		{"/promise/domains/example.com/.color", nil, unknownCommandError},
+		{"/promise/domains/example.com/.hidden/.service", nil, unknownCommandError},
+		{"/promise/domains/example.com/a%zz/.service", nil, invalidEscapeError},
+		{"/promise/domains/example.com", nil, nodeComponentsError},
+		{"/promise/services/web/1", &parsedKey{kind: servicesKind, name: "web", detail: "1"}, nil},
+		{"/promise/services/web/.protocol", &parsedKey{kind: servicesKind, name: "web", detail: ".protocol"}, nil},
+		{"/promise/services/web/a/b", nil, nodeComponentsError},
+		{"/promise/services/web", nil, nodeComponentsError},
+		{"/promise/.commit", &parsedKey{kind: reservedKind, name: commitKey}, nil},
+		{"/promise/.status", &parsedKey{kind: reservedKind, name: statusKey}, nil},
+		{"/promise/.other", nil, nodeComponentsError},
+		{"/promise/elsewhere/a/b", nil, unknownKindError},
+		{"/promise//domains/example.com/.service", nil, emptySegmentError},
+		{"/other/domains/example.com/.service", nil, outsideRootError},
+	}
+
+	for _, test := range tests {
+		parsed, err := parseKey("promise", test.key)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.key, test.err, err)
+			continue
+		}
+
+		if test.expected != nil && *parsed != *test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.key, test.expected, parsed)
+		}
+	}
+}
+
+func TestParseKeyRoot(t *testing.T) {
+	for _, rootKey := range []string{"promise/elections", "/promise/elections", "promise/elections/"} {
+		parsed, err := parseKey(rootKey, "/promise/elections/domains/example.com/.service")
+		if err != nil {
+			t.Errorf("%s: %v", rootKey, err)
+		} else if parsed.name != "example.com" {
+			t.Errorf("%s: unexpected name %q", rootKey, parsed.name)
+		}
+	}
+}
+
+func TestDomainKey(t *testing.T) {
+	for _, prefix := range []string{"", "api", "api/", "api/v2", ".well-known", "a%2Fb", "with space"} {
+		key := domainKey("promise", "example.com", prefix)
+		parsed, err := parseKey("promise", key)
+		if err != nil {
+			t.Errorf("%q: %s: %v", prefix, key, err)
+		} else if parsed.kind != domainsKind || parsed.name != "example.com" || parsed.prefix != prefix {
+			t.Errorf("%q: %s: unexpected key %+v", prefix, key, parsed)
+		}
+	}
+}
@@ -20,6 +20,21 @@ func newMatcher() *matcher {
 	}
 }
 
+// clone returns a copy of the matcher that can be changed independently.
+func (m *matcher) clone() *matcher {
+	c := &matcher{
+		prefixesList: make([]string, len(m.prefixesList)),
+		prefixes:     make(map[string]string, len(m.prefixes)),
+	}
+
+	copy(c.prefixesList, m.prefixesList)
+	for prefix, value := range m.prefixes {
+		c.prefixes[prefix] = value
+	}
+
+	return c
+}
+
 func (m *matcher) setPrefix(prefix, value string) {
 
 	// We only want to add this value to the list if we haven't seen it before.
@@ -75,14 +90,20 @@ func (m *matcher) removePrefix(prefix string) {
 }
 
 func (m *matcher) match(path string) (string, error) {
+	_, value, err := m.matchPrefix(path)
+	return value, err
+}
+
+// matchPrefix returns the matching prefix along with its value.
+func (m *matcher) matchPrefix(path string) (string, string, error) {
 
 	// The list of path prefixes is in reverse order by string length. We want
 	// to return the first (most specific) match we come accross.
 	for _, prefix := range m.prefixesList {
 		if strings.HasPrefix(path, prefix) {
-			return m.prefixes[prefix], nil
+			return prefix, m.prefixes[prefix], nil
 		}
 	}
 
-	return "", noMatchingPrefixError
+	return "", "", noMatchingPrefixError
 }
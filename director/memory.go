@@ -0,0 +1,102 @@
+package director
+
+const (
+
+	// memoryRootKey is the root key the configuration of a memory director is
+	// kept under. It never leaves the director.
+	memoryRootKey = "memory"
+)
+
+// MemoryDirector routes according to a configuration changed by calling its
+// methods, rather than read from a configuration source. Its methods are the
+// same operations as setting and deleting keys in etcd, and may be called
+// concurrently with each other and with picks. Each change is published as
+// soon as it's made.
+type MemoryDirector struct {
+	*keyState
+}
+
+// NewMemoryDirector returns a director without any domains or services.
+func NewMemoryDirector() *MemoryDirector {
+	return &MemoryDirector{keyState: newKeyState(memoryRootKey)}
+}
+
+// set applies and publishes the value of a key. A value that can't be applied
+// is returned as a rejection, leaving the configuration as it was.
+func (m *MemoryDirector) set(key, value string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	previous, ok := m.nodes[key]
+	m.setKey(key, value)
+
+	if rejection, rejected := m.rejected[key]; rejected {
+		m.deleteKey(key)
+		if ok {
+			m.setKey(key, previous)
+		}
+
+		// Restoring the keys above puts nodes and rejected back. Every
+		// earlier change was published, since a memory director never sets
+		// the commit key, so the pending changes hold only this attempt and
+		// dropping them restores the table.
+		m.pending = nil
+		return rejection
+	}
+
+	m.commit()
+	return nil
+}
+
+// unset removes and publishes the removal of a key, or of every key under
+// it.
+func (m *MemoryDirector) unset(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.deleteKey(key)
+	m.commit()
+}
+
+// SetServicePrefix routes requests for the domain whose paths start with the
+// prefix to the service. The empty prefix matches every path.
+func (m *MemoryDirector) SetServicePrefix(dn, prefix, service string) error {
+	return m.set(domainKey(m.rootKey, dn, prefix), service)
+}
+
+// RemoveServicePrefix stops routing the prefix of the domain.
+func (m *MemoryDirector) RemoveServicePrefix(dn, prefix string) {
+	m.unset(domainKey(m.rootKey, dn, prefix))
+}
+
+// RemoveDomain stops routing every prefix of the domain.
+func (m *MemoryDirector) RemoveDomain(dn string) {
+	m.unset(domainsKey(m.rootKey, dn))
+}
+
+// SetServiceAddr sets the named address of the service, such as
+// 127.0.0.1:8080 or unix:///run/app.sock.
+func (m *MemoryDirector) SetServiceAddr(service, name, addr string) error {
+	return m.set(serviceKey(m.rootKey, service, name), addr)
+}
+
+// RemoveServiceAddr removes the named address of the service.
+func (m *MemoryDirector) RemoveServiceAddr(service, name string) {
+	m.unset(serviceKey(m.rootKey, service, name))
+}
+
+// SetServiceSetting sets a setting of the service, such as protocol or
+// timeout, validating the value.
+func (m *MemoryDirector) SetServiceSetting(service, key, value string) error {
+	return m.set(serviceKey(m.rootKey, service, "."+key), value)
+}
+
+// RemoveServiceSetting returns a setting of the service to its default.
+func (m *MemoryDirector) RemoveServiceSetting(service, key string) {
+	m.unset(serviceKey(m.rootKey, service, "."+key))
+}
+
+// RemoveService removes every address and setting of the service.
+func (m *MemoryDirector) RemoveService(service string) {
+	m.unset(serviceKey(m.rootKey, service, ""))
+}
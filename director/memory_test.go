@@ -0,0 +1,80 @@
+package director
+
+import (
+	"testing"
+)
+
+func TestMemoryDirector(t *testing.T) {
+	m := NewMemoryDirector()
+	if err := m.SetServicePrefix("localhost", "", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetServicePrefix("localhost", "api/", "api"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetServiceAddr("web", "1", "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetServiceAddr("api", "1", "unix:///run/api.sock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetServiceSetting("web", "protocol", "h2c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint, err := m.Pick("localhost", "/api/users"); err != nil || endpoint.Addr.String() != "/run/api.sock" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	endpoint, err := m.Pick("localhost", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint.Addr.String() != "127.0.0.1:8080" || endpoint.Config.Protocol != ProtocolH2C {
+		t.Errorf("unexpected endpoint %+v", endpoint)
+	}
+
+	// Invalid values should be returned as errors, leaving the configuration
+	// as it was.
+	if err := m.SetServiceAddr("web", "1", "127.0.0.1"); err == nil {
+		t.Error("no error reported for an address without a port")
+	}
+	if err := m.SetServiceSetting("web", "protocol", "bogus"); err == nil {
+		t.Error("no error reported for an unknown protocol")
+	}
+	if err := m.SetServiceAddr("web/1", "1", "127.0.0.1:8080"); err == nil {
+		t.Error("no error reported for an invalid service name")
+	}
+
+	if endpoint, err := m.PickService("web"); err != nil || endpoint.Addr.String() != "127.0.0.1:8080" || endpoint.Config.Protocol != ProtocolH2C {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	// A rejected value for a new service shouldn't leave it behind, empty.
+	if err := m.SetServiceSetting("new", "timeout", "-1s"); err == nil {
+		t.Error("no error reported for a negative timeout")
+	}
+	if _, ok := m.Table().Services["new"]; ok {
+		t.Error("a rejected setting left its service in the table")
+	}
+
+	if rejections := m.Rejections(); len(rejections) != 0 {
+		t.Errorf("unexpected rejections %v", rejections)
+	}
+
+	m.RemoveServicePrefix("localhost", "api/")
+	if endpoint, err := m.Pick("localhost", "/api/users"); err != nil || endpoint.Service != "web" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	m.RemoveService("web")
+	if _, err := m.PickService("web"); err == nil {
+		t.Error("removed service is still picked")
+	}
+
+	m.RemoveDomain("localhost")
+	if view := m.Table(); len(view.Domains) != 0 || len(view.Services) != 1 {
+		t.Errorf("unexpected table %+v", view)
+	}
+}
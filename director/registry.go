@@ -0,0 +1,259 @@
+package director
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	missingRootKeyError = errors.New("director URL has no root key")
+	missingAddrError    = errors.New("director URL has no address")
+	missingPathError    = errors.New("director URL has no path")
+
+	conflictingOptionsError = errors.New("director is already open with different options")
+)
+
+// Options configures a director opened from a URL. Factories apply the
+// options their directors support and ignore the rest.
+type Options struct {
+
+	// BatchWindow is how long to wait for further updates before applying
+	// them together. Zero leaves the director's default.
+	BatchWindow time.Duration
+
+	// WriteStatus enables reporting rejected keys back to the source.
+	WriteStatus bool
+
+	// SnapshotPath, if set, is a file the published configuration is saved
+	// to and served from while the source is unreachable.
+	SnapshotPath string
+
+	// EtcdMachines, if set, are the addresses of the etcd machines, such as
+	// http://127.0.0.1:4001, read by etcd and etcd3 URLs without a host,
+	// such as etcd:///promise.
+	EtcdMachines []string
+
+	// ConsulAddr, if set, is the address of the Consul agent, such as
+	// http://127.0.0.1:8500, read by consul URLs without a host.
+	ConsulAddr string
+}
+
+// Factory creates a director from a URL whose scheme it was registered for.
+// Options are never nil. The director shouldn't be watching yet: Open
+// starts directors with a Watch method once they're created.
+type Factory func(u *url.URL, options *Options) (Director, error)
+
+// Watcher is implemented by directors that keep themselves up to date. Watch
+// runs until the process exits.
+type Watcher interface {
+	Watch()
+}
+
+var (
+	factoriesLock sync.RWMutex
+	factories     = make(map[string]Factory)
+
+	// clusters holds the etcd clusters shared by every director opened from
+	// a URL naming the same scheme and machines.
+	clustersLock sync.Mutex
+	clusters     = make(map[string]*EtcdCluster)
+)
+
+// Register makes a director type available to Open under the URL scheme. It
+// panics if the scheme is already registered or the factory is nil, and is
+// meant to be called from the init function of the package providing the
+// director.
+func Register(scheme string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if factory == nil {
+		panic("director: Register factory is nil")
+	}
+	if _, ok := factories[scheme]; ok {
+		panic("director: Register called twice for scheme " + scheme)
+	}
+	factories[scheme] = factory
+}
+
+// Schemes returns the registered URL schemes, sorted.
+func Schemes() []string {
+	factoriesLock.RLock()
+	defer factoriesLock.RUnlock()
+
+	schemes := make([]string, 0, len(factories))
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open creates a director from a URL, such as etcd://127.0.0.1:4001/promise,
+// file:///etc/promise/routes.yaml or static:127.0.0.1:8080, using the
+// factory registered for its scheme, and starts it watching for updates.
+// Options may be nil.
+func Open(rawurl string, options *Options) (Director, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	factoriesLock.RLock()
+	factory, ok := factories[u.Scheme]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("director: unknown scheme %q", u.Scheme)
+	}
+
+	if options == nil {
+		options = &Options{}
+	}
+
+	d, err := factory(u, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if w, ok := d.(Watcher); ok {
+		go w.Watch()
+	}
+	return d, nil
+}
+
+func init() {
+	Register("etcd", openEtcd)
+	Register("etcd3", openEtcd3)
+	Register("consul", openConsul)
+	Register("file", openFile)
+	Register("static", openStatic)
+}
+
+// urlRootKey returns the root key named by the path of the URL.
+func urlRootKey(u *url.URL) (string, error) {
+	rootKey := strings.Trim(u.Path, "/")
+	if rootKey == "" {
+		return "", missingRootKeyError
+	}
+	return rootKey, nil
+}
+
+// urlMachines returns the HTTP address of every host of the URL, delimited
+// by semicolons so that URLs can be listed with commas. A URL without a host
+// gets the default machines or, if there are none, the default host.
+func urlMachines(u *url.URL, defaultMachines []string, defaultHost string) []string {
+	if u.Host == "" && len(defaultMachines) > 0 {
+		return defaultMachines
+	}
+
+	host := u.Host
+	if host == "" {
+		host = defaultHost
+	}
+
+	var machines []string
+	for _, h := range strings.Split(host, ";") {
+		machines = append(machines, "http://"+h)
+	}
+	return machines
+}
+
+// sharedCluster returns the cluster shared by every director opened from a
+// URL naming the same scheme and machines, creating it with the function if
+// it's the first. The options of the first URL configure the cluster.
+func sharedCluster(u *url.URL, machines []string, options *Options, newCluster func([]string) *EtcdCluster) *EtcdCluster {
+	clustersLock.Lock()
+	defer clustersLock.Unlock()
+
+	key := u.Scheme + "://" + strings.Join(machines, ",")
+	c, ok := clusters[key]
+	if !ok {
+		c = newCluster(machines)
+		if options.BatchWindow > 0 {
+			c.BatchWindow = options.BatchWindow
+		}
+		clusters[key] = c
+	}
+	return c
+}
+
+// openEtcd opens a URL such as etcd://127.0.0.1:4001;127.0.0.2:4001/promise,
+// reading the root key through the etcd v2 API. Directors of the same
+// machines share a single client and watch, and opening the same root key
+// again returns the same director, as long as the options agree.
+func openEtcd(u *url.URL, options *Options) (Director, error) {
+	rootKey, err := urlRootKey(u)
+	if err != nil {
+		return nil, err
+	}
+
+	machines := urlMachines(u, options.EtcdMachines, "127.0.0.1:4001")
+	d, err := sharedCluster(u, machines, options, NewEtcdCluster).openDirector(rootKey, options.WriteStatus, options.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// openEtcd3 opens a URL such as etcd3://127.0.0.1:2379/promise, reading the
+// root key through the etcd v3 API. Directors of the same endpoints share a
+// single client and watch.
+func openEtcd3(u *url.URL, options *Options) (Director, error) {
+	rootKey, err := urlRootKey(u)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := urlMachines(u, options.EtcdMachines, "127.0.0.1:2379")
+	d, err := sharedCluster(u, endpoints, options, NewEtcd3Cluster).openDirector(rootKey, options.WriteStatus, options.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// openConsul opens a URL such as consul://127.0.0.1:8500/promise.
+func openConsul(u *url.URL, options *Options) (Director, error) {
+	rootKey, err := urlRootKey(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultAddrs []string
+	if options.ConsulAddr != "" {
+		defaultAddrs = []string{options.ConsulAddr}
+	}
+
+	d := NewConsulDirector(rootKey, urlMachines(u, defaultAddrs, "127.0.0.1:8500")[0])
+	d.SnapshotPath = options.SnapshotPath
+	return d, nil
+}
+
+// openFile opens a URL such as file:///etc/promise/routes.yaml or
+// file:///etc/promise/routes.json.
+func openFile(u *url.URL, options *Options) (Director, error) {
+	if u.Path == "" {
+		return nil, missingPathError
+	}
+	return NewFileDirector(u.Path), nil
+}
+
+// openStatic opens a URL such as static:127.0.0.1:8080 or
+// static:unix:///run/app.sock, routing everything to the address. The
+// address is required.
+func openStatic(u *url.URL, options *Options) (Director, error) {
+	if u.Opaque == "" {
+		return nil, missingAddrError
+	}
+
+	addr, err := parseAddr(u.Opaque)
+	if err != nil {
+		return nil, err
+	}
+	return NewStaticDirector(addr), nil
+}
@@ -0,0 +1,120 @@
+package director
+
+import (
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	d, err := Open("static:127.0.0.1:8080", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint, err := d.Pick("localhost", "/"); err != nil || endpoint.Addr.String() != "127.0.0.1:8080" {
+		t.Errorf("unexpected endpoint %+v, %v", endpoint, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	writeRoutes(t, path, "domains:\n  localhost:\n    \"\": web\nservices:\n  web:\n    addrs:\n      \"1\": 127.0.0.1:8081\n")
+
+	d, err = Open((&url.URL{Scheme: "file", Path: path}).String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		endpoint, err := d.Pick("localhost", "/")
+		return err == nil && endpoint.Addr.String() == "127.0.0.1:8081"
+	})
+
+	for _, rawurl := range []string{
+		"bogus://127.0.0.1/promise",
+		"promise",
+		"static:",
+		"etcd://127.0.0.1:4001/",
+		"file://",
+	} {
+		if _, err := Open(rawurl, nil); err == nil {
+			t.Errorf("%s: no error reported", rawurl)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	opened := make(chan *url.URL, 1)
+	Register("test", func(u *url.URL, options *Options) (Director, error) {
+		opened <- u
+		return NewStaticDirector(nil), nil
+	})
+
+	if _, err := Open("test://example/promise", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := <-opened; u.Host != "example" || u.Path != "/promise" {
+		t.Errorf("unexpected URL %s", u)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a scheme twice didn't panic")
+		}
+	}()
+	Register("test", openStatic)
+}
+
+func TestOpenEtcd(t *testing.T) {
+	u, err := url.Parse("etcd://10.0.0.1:4001;10.0.0.2:4001/promise/a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := openEtcd(u, &Options{BatchWindow: time.Second, WriteStatus: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := d.(*etcdDirector)
+	if e.etcdRootKey != "promise/a" || e.cluster.BatchWindow != time.Second || !e.WriteStatus {
+		t.Errorf("unexpected director %+v", e)
+	}
+
+	if machines := e.cluster.backend.(*etcdBackend).client.GetCluster(); !reflect.DeepEqual(machines, []string{"http://10.0.0.1:4001", "http://10.0.0.2:4001"}) {
+		t.Errorf("unexpected machines %q", machines)
+	}
+
+	// Other root keys of the same machines share the cluster, including
+	// those of URLs that leave the machines to the options.
+	u, err = url.Parse("etcd:///promise/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openEtcd(u, &Options{EtcdMachines: []string{"http://10.0.0.1:4001", "http://10.0.0.2:4001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other.(*etcdDirector).cluster != e.cluster {
+		t.Error("directors of the same machines don't share a cluster")
+	}
+
+	// Opening the same root key again returns the same director, which may
+	// already be watched, so its options can't change.
+	u, err = url.Parse("etcd://10.0.0.1:4001;10.0.0.2:4001/promise/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if same, err := openEtcd(u, &Options{WriteStatus: true}); err != nil || same != d {
+		t.Errorf("unexpected director %v, %v", same, err)
+	}
+
+	if _, err := openEtcd(u, &Options{WriteStatus: true, SnapshotPath: "/tmp/a.json"}); err != conflictingOptionsError {
+		t.Errorf("expected %v, got %v", conflictingOptionsError, err)
+	}
+}
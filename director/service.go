@@ -3,33 +3,97 @@ package director
 import (
 	"errors"
 	"net"
+	"strings"
 	"sync/atomic"
 )
 
+const (
+	unixAddrPrefix = "unix://"
+)
+
 var (
 	noAvailableAddrError = errors.New("no available address")
+	invalidPortError     = errors.New("invalid port")
 )
 
+// parseAddr parses a service address value. Values of the form
+// unix:///path/to.sock name a Unix domain socket, anything else is resolved as
+// a TCP host:port pair.
+func parseAddr(value string) (net.Addr, error) {
+	if strings.HasPrefix(value, unixAddrPrefix) {
+		return &net.UnixAddr{
+			Name: strings.TrimPrefix(value, unixAddrPrefix),
+			Net:  "unix",
+		}, nil
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for a valid port.
+	if addr.Port <= 0 {
+		return nil, invalidPortError
+	}
+
+	return addr, nil
+}
+
 type service struct {
-	addrsList []*net.TCPAddr
-	addrs     map[string]*net.TCPAddr
-	index     uint32
+	addrsList []net.Addr
+	addrs     map[string]net.Addr
+	settings  map[string]string
+	config    ServiceConfig
+
+	// index is the round-robin position. It's shared with clones of the
+	// service, so the position survives configuration changes.
+	index *uint32
+
+	// srv resolves the targets of the SRV setting, if there is one. Like the
+	// index, it's shared with clones, so cached records survive changes.
+	srv *srvResolver
 }
 
 func newService() *service {
 	return &service{
-		addrs: make(map[string]*net.TCPAddr),
+		addrs:    make(map[string]net.Addr),
+		settings: make(map[string]string),
+		config:   ServiceConfig{Protocol: ProtocolHTTP},
+		index:    new(uint32),
 	}
 }
 
+// clone returns a copy of the service that can be changed independently.
+func (g *service) clone() *service {
+	c := &service{
+		addrsList: g.addrsList,
+		addrs:     make(map[string]net.Addr, len(g.addrs)),
+		settings:  make(map[string]string, len(g.settings)),
+		config:    g.config,
+		index:     g.index,
+		srv:       g.srv,
+	}
+
+	for name, addr := range g.addrs {
+		c.addrs[name] = addr
+	}
+
+	for key, value := range g.settings {
+		c.settings[key] = value
+	}
+
+	return c
+}
+
 func (g *service) refigure() {
-	g.addrsList = make([]*net.TCPAddr, 0, len(g.addrs))
+	g.addrsList = make([]net.Addr, 0, len(g.addrs))
 	for _, addr := range g.addrs {
 		g.addrsList = append(g.addrsList, addr)
 	}
 }
 
-func (g *service) setAddr(name string, addr *net.TCPAddr) {
+func (g *service) setAddr(name string, addr net.Addr) {
 	g.addrs[name] = addr
 	g.refigure()
 }
@@ -39,7 +103,51 @@ func (g *service) removeAddr(name string) {
 	g.refigure()
 }
 
-func (g *service) pick() (*net.TCPAddr, error) {
+// setSetting validates and applies a service setting.
+func (g *service) setSetting(key, value string) error {
+	if err := validateSetting(key, value); err != nil {
+		return err
+	}
+
+	g.settings[key] = value
+	g.config, _ = newServiceConfig(g.settings)
+	g.refigureSRV()
+	return nil
+}
+
+func (g *service) removeSetting(key string) {
+	delete(g.settings, key)
+	g.config, _ = newServiceConfig(g.settings)
+	g.refigureSRV()
+}
+
+// refigureSRV replaces the SRV resolver when the SRV setting changes.
+func (g *service) refigureSRV() {
+	switch {
+	case g.config.SRV == "":
+		g.srv = nil
+	case g.srv == nil || g.srv.setting != g.config.SRV:
+		g.srv = newSRVResolver(g.config.SRV)
+	}
+}
+
+// empty reports whether or not the service has any addresses or settings.
+func (g *service) empty() bool {
+	return len(g.addrs) == 0 && len(g.settings) == 0
+}
+
+func (g *service) pick() (net.Addr, error) {
+
+	// SRV targets take precedence over explicit addresses, which are used
+	// until records arrive, or when there aren't any. SRV records stating
+	// that the service isn't available are final.
+	if g.srv != nil {
+		addr, err := g.srv.pick()
+		if err == nil || err == unavailableSRVError || len(g.addrsList) == 0 {
+			return addr, err
+		}
+	}
+
 	n := len(g.addrsList)
 	switch {
 	case n == 0:
@@ -48,6 +156,6 @@ func (g *service) pick() (*net.TCPAddr, error) {
 		return g.addrsList[0], nil
 	}
 
-	i := atomic.AddUint32(&g.index, uint32(1)) % uint32(n)
+	i := atomic.AddUint32(g.index, uint32(1)) % uint32(n)
 	return g.addrsList[i], nil
 }
@@ -30,6 +30,30 @@ func TestService(t *testing.T) {
 	}
 }
 
+func TestParseAddr(t *testing.T) {
+	addr, err := parseAddr("unix:///run/app.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.Network() != "unix" || addr.String() != "/run/app.sock" {
+		t.Errorf("unexpected unix addr %s://%s", addr.Network(), addr)
+	}
+
+	addr, err = parseAddr("127.0.0.1:4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.Network() != "tcp" || addr.String() != "127.0.0.1:4001" {
+		t.Errorf("unexpected tcp addr %s://%s", addr.Network(), addr)
+	}
+
+	if _, err := parseAddr("127.0.0.1:0"); err == nil {
+		t.Error("no error reported for an invalid port")
+	}
+}
+
 func BenchmarkServicePickEmpty(b *testing.B) {
 	s := newService()
 
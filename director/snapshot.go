@@ -0,0 +1,61 @@
+package director
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshot is the on-disk form of the last published configuration: the
+// value of every key the routing table was built from, and the time it was
+// saved, when the source had last confirmed it.
+type snapshot struct {
+	Nodes map[string]string `json:"nodes"`
+	Saved time.Time         `json:"saved"`
+}
+
+// writeSnapshot saves the nodes to the path. It writes a temporary file first
+// and renames it, so a crash never leaves a partial snapshot behind.
+func writeSnapshot(path string, nodes map[string]string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(&snapshot{Nodes: nodes, Saved: time.Now()}); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readSnapshot loads the nodes saved by writeSnapshot, along with the time
+// they were saved. Snapshots written without a save time fall back to the
+// modification time of the file.
+func readSnapshot(path string) (map[string]string, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	var s snapshot
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if s.Saved.IsZero() {
+		if info, err := f.Stat(); err == nil {
+			s.Saved = info.ModTime()
+		}
+	}
+
+	return s.Nodes, s.Saved, nil
+}
@@ -0,0 +1,481 @@
+package director
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsTypeSRV   = 33
+	dnsClassINET = 1
+
+	dnsFlagResponse  = 1 << 15
+	dnsFlagTruncated = 1 << 9
+	dnsFlagRecursion = 1 << 8
+
+	dnsRcodeNameError = 3
+
+	// dnsTimeout bounds a single DNS exchange.
+	dnsTimeout = 5 * time.Second
+
+	// minSRVTTL and srvRetryInterval keep very short TTLs and failing
+	// lookups from causing a query on every request.
+	minSRVTTL        = time.Second
+	srvRetryInterval = 5 * time.Second
+)
+
+var (
+	emptySRVError        = errors.New("srv setting needs a name")
+	malformedDNSError    = errors.New("malformed DNS message")
+	dnsResponseError     = errors.New("DNS server responded with an error")
+	noSRVRecordsError    = errors.New("no SRV records")
+	unavailableSRVError  = errors.New("service decidedly not available, according to its SRV records")
+	noNameserversError   = errors.New("no nameservers configured")
+	mismatchedDNSIDError = errors.New("DNS response doesn't match the query")
+)
+
+// srvRecord is a target of an SRV record.
+type srvRecord struct {
+	priority, weight uint16
+	target           string
+	port             uint16
+}
+
+// srvAddr is the address of an SRV target. The target is a host name, which
+// is resolved when dialing.
+type srvAddr struct {
+	host string
+	port uint16
+}
+
+func (a *srvAddr) Network() string {
+	return "tcp"
+}
+
+func (a *srvAddr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(int(a.port)))
+}
+
+// parseSRVSetting splits a srv setting of the form name[@host[:port]] into
+// the record name and the nameserver to ask, if any.
+func parseSRVSetting(value string) (name, nameserver string, err error) {
+	name, nameserver, _ = strings.Cut(value, "@")
+	if name == "" {
+		return "", "", emptySRVError
+	}
+
+	if nameserver != "" {
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			nameserver = net.JoinHostPort(nameserver, "53")
+		}
+	}
+
+	return name, nameserver, nil
+}
+
+// systemNameservers returns the nameservers of /etc/resolv.conf.
+func systemNameservers() []string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var nameservers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+
+	return nameservers
+}
+
+// srvResolver looks up the targets of an SRV name and caches them for the
+// TTL of the records. Lookups only ever run in the background, so picks never
+// wait on DNS: the first lookup starts as the resolver is created, and once
+// records expire, picks keep using them while they're refreshed. It's shared
+// by clones of a service, like the round-robin position.
+type srvResolver struct {
+	setting    string
+	name       string
+	nameserver string
+
+	lock       sync.Mutex
+	records    []*srvRecord
+	expires    time.Time
+	resolved   bool
+	refreshing bool
+	err        error
+}
+
+func newSRVResolver(setting string) *srvResolver {
+	name, nameserver, _ := parseSRVSetting(setting)
+	r := &srvResolver{
+		setting:    setting,
+		name:       name,
+		nameserver: nameserver,
+		refreshing: true,
+	}
+
+	go r.refresh()
+	return r
+}
+
+// refresh looks up the records and stores the result.
+func (r *srvResolver) refresh() {
+	records, ttl, err := r.lookup()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.store(records, ttl, err)
+	r.refreshing = false
+}
+
+// lookup queries the nameserver, or each system nameserver in turn, for the
+// SRV records. It returns them with the shortest of their TTLs.
+func (r *srvResolver) lookup() ([]*srvRecord, time.Duration, error) {
+	nameservers := []string{r.nameserver}
+	if r.nameserver == "" {
+		nameservers = systemNameservers()
+	}
+
+	err := noNameserversError
+	for _, nameserver := range nameservers {
+		var records []*srvRecord
+		var ttl time.Duration
+		records, ttl, err = querySRV(nameserver, r.name)
+		if err == nil {
+			return records, ttl, nil
+		}
+	}
+
+	return nil, 0, err
+}
+
+// store records the result of a lookup. Failed lookups keep the previous
+// records, while a name without records, or whose service isn't available,
+// clears them. It expects the caller to hold the lock.
+func (r *srvResolver) store(records []*srvRecord, ttl time.Duration, err error) {
+	r.resolved = true
+	r.err = err
+	if err != nil {
+		if err == noSRVRecordsError || err == unavailableSRVError {
+			r.records = nil
+		}
+		r.expires = time.Now().Add(srvRetryInterval)
+		return
+	}
+
+	if ttl < minSRVTTL {
+		ttl = minSRVTTL
+	}
+	r.records = records
+	r.expires = time.Now().Add(ttl)
+}
+
+// targets returns the current records, refreshing them in the background
+// once they expire. Until the first lookup completes, there are no records.
+func (r *srvResolver) targets() ([]*srvRecord, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.resolved {
+		return nil, noSRVRecordsError
+	}
+
+	if !r.refreshing && time.Now().After(r.expires) {
+		r.refreshing = true
+		go r.refresh()
+	}
+
+	if len(r.records) == 0 {
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, noSRVRecordsError
+	}
+
+	return r.records, nil
+}
+
+// pick selects a target according to RFC 2782: only the targets with the
+// lowest priority are considered, and among those each is picked with a
+// probability proportional to its weight. Targets with a weight of 0 come
+// first in a random order, and share a small chance of being picked.
+func (r *srvResolver) pick() (net.Addr, error) {
+	records, err := r.targets()
+	if err != nil {
+		return nil, err
+	}
+
+	// The records are sorted by priority.
+	var candidates []*srvRecord
+	var total int
+	for _, record := range records {
+		if record.priority != records[0].priority {
+			break
+		}
+		candidates = append(candidates, record)
+		total += int(record.weight)
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight == 0 && candidates[j].weight != 0
+	})
+
+	// Pick the first target whose running sum of weights reaches a random
+	// number between 0 and the total, inclusive.
+	chosen := candidates[0]
+	n, sum := rand.Intn(total+1), 0
+	for _, record := range candidates {
+		sum += int(record.weight)
+		if sum >= n {
+			chosen = record
+			break
+		}
+	}
+
+	return &srvAddr{host: chosen.target, port: chosen.port}, nil
+}
+
+// querySRV asks the nameserver for the SRV records of the name, over UDP
+// and, if the response is truncated, again over TCP. The records are sorted
+// by priority.
+func querySRV(nameserver, name string) ([]*srvRecord, time.Duration, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildSRVQuery(id, name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := exchangeDNS("udp", nameserver, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records, ttl, truncated, err := parseSRVResponse(id, response)
+	if err == nil && truncated {
+		if response, err = exchangeDNS("tcp", nameserver, query); err != nil {
+			return nil, 0, err
+		}
+		records, ttl, _, err = parseSRVResponse(id, response)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].priority < records[j].priority
+	})
+
+	return records, ttl, nil
+}
+
+// exchangeDNS sends a query and reads the response. Over TCP, messages are
+// prefixed with their length.
+func exchangeDNS(network, nameserver string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, nameserver, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "tcp" {
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return response[:n], nil
+}
+
+// buildSRVQuery encodes a recursive query for the SRV records of the name.
+func buildSRVQuery(id uint16, name string) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsFlagRecursion)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // questions
+	msg = append(msg, 0, 0, 0, 0, 0, 0)         // answers, authorities, additionals
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, malformedDNSError
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSRV)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassINET)
+	return msg, nil
+}
+
+// parseSRVResponse decodes the SRV records of a response, along with the
+// shortest of their TTLs and whether or not the response was truncated.
+func parseSRVResponse(id uint16, msg []byte) ([]*srvRecord, time.Duration, bool, error) {
+	if len(msg) < 12 {
+		return nil, 0, false, malformedDNSError
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	switch {
+	case binary.BigEndian.Uint16(msg) != id || flags&dnsFlagResponse == 0:
+		return nil, 0, false, mismatchedDNSIDError
+	case flags&dnsFlagTruncated != 0:
+		return nil, 0, true, nil
+	case flags&0xf == dnsRcodeNameError:
+		return nil, 0, false, noSRVRecordsError
+	case flags&0xf != 0:
+		return nil, 0, false, dnsResponseError
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, 0, false, err
+		}
+		off += 4
+	}
+
+	var records []*srvRecord
+	var ttl time.Duration
+	for i := 0; i < answers; i++ {
+		var err error
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, 0, false, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, false, malformedDNSError
+		}
+
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rrTTL := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, 0, false, malformedDNSError
+		}
+
+		// Answers can include other types, such as the CNAME the name
+		// pointed to.
+		if rrType == dnsTypeSRV {
+			if length < 7 {
+				return nil, 0, false, malformedDNSError
+			}
+
+			target, _, err := readDNSName(msg, off+6)
+			if err != nil {
+				return nil, 0, false, err
+			}
+
+			records = append(records, &srvRecord{
+				priority: binary.BigEndian.Uint16(msg[off:]),
+				weight:   binary.BigEndian.Uint16(msg[off+2:]),
+				port:     binary.BigEndian.Uint16(msg[off+4:]),
+				target:   target,
+			})
+
+			if ttl == 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		off += length
+	}
+
+	if len(records) == 0 {
+		return nil, 0, false, noSRVRecordsError
+	}
+
+	// A target of "." means the service is decidedly not available.
+	var available []*srvRecord
+	for _, record := range records {
+		if record.target != "" {
+			available = append(available, record)
+		}
+	}
+	if len(available) == 0 {
+		return nil, ttl, false, unavailableSRVError
+	}
+
+	return available, ttl, false, nil
+}
+
+// readDNSName decodes a possibly compressed name at the offset, returning it
+// without the trailing dot and the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, malformedDNSError
+		}
+
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+
+			// A pointer to the rest of the name elsewhere in the message.
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, malformedDNSError
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, malformedDNSError
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
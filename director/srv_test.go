@@ -0,0 +1,298 @@
+package director
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDNS answers SRV queries over UDP and TCP on the same port from a
+// changeable set of records. With truncate set, UDP responses are truncated
+// so that clients have to retry over TCP.
+type fakeDNS struct {
+	lock     sync.Mutex
+	records  map[string][]*srvRecord
+	ttl      uint32
+	truncate bool
+	queries  int
+}
+
+func (f *fakeDNS) respond(query []byte, tcp bool) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.queries++
+
+	name, end, err := readDNSName(query, 12)
+	if err != nil {
+		return nil
+	}
+
+	records, ok := f.records[name]
+
+	flags := uint16(dnsFlagResponse | dnsFlagRecursion | 1<<7)
+	if !ok {
+		flags |= dnsRcodeNameError
+	}
+	if f.truncate && !tcp {
+		flags |= dnsFlagTruncated
+		records = nil
+	}
+
+	msg := append([]byte{}, query[:2]...)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(records)))
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, query[12:end+4]...)
+
+	for _, record := range records {
+		var target []byte
+		if record.target != "" {
+			for _, label := range strings.Split(record.target, ".") {
+				target = append(target, byte(len(label)))
+				target = append(target, label...)
+			}
+		}
+		target = append(target, 0)
+
+		// Point back to the name in the question.
+		msg = append(msg, 0xc0, 12)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeSRV)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassINET)
+		msg = binary.BigEndian.AppendUint32(msg, f.ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(6+len(target)))
+		msg = binary.BigEndian.AppendUint16(msg, record.priority)
+		msg = binary.BigEndian.AppendUint16(msg, record.weight)
+		msg = binary.BigEndian.AppendUint16(msg, record.port)
+		msg = append(msg, target...)
+	}
+
+	return msg
+}
+
+// serve starts the fake on a local port and returns its address.
+func (f *fakeDNS) serve(t *testing.T) string {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(f.respond(buf[:n], false), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+
+			var length [2]byte
+			conn.Read(length[:])
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			conn.Read(query)
+
+			response := f.respond(query, true)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			conn.Close()
+		}
+	}()
+
+	return tcp.Addr().String()
+}
+
+func TestSRVResolver(t *testing.T) {
+	fake := &fakeDNS{ttl: 60, records: map[string][]*srvRecord{
+		"_http._tcp.api.internal": {
+			{priority: 1, weight: 100, target: "backup.internal", port: 8000},
+			{priority: 0, weight: 3, target: "a.internal", port: 8080},
+			{priority: 0, weight: 1, target: "b.internal", port: 8081},
+		},
+	}}
+	nameserver := fake.serve(t)
+
+	r := newSRVResolver("_http._tcp.api.internal@" + nameserver)
+	waitFor(t, func() bool {
+		_, err := r.pick()
+		return err == nil
+	})
+
+	picks := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		addr, err := r.pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[addr.String()]++
+	}
+
+	if picks["backup.internal:8000"] != 0 {
+		t.Error("picked a target with a higher priority value")
+	}
+
+	if a, b := picks["a.internal:8080"], picks["b.internal:8081"]; a < 2*b || b == 0 {
+		t.Errorf("picks don't follow the weights: %v", picks)
+	}
+
+	// Once the records expire, they should be refreshed in the background.
+	fake.lock.Lock()
+	if fake.queries != 1 {
+		t.Errorf("records were looked up %d times within their TTL", fake.queries)
+	}
+	fake.records["_http._tcp.api.internal"] = []*srvRecord{{target: "c.internal", port: 8082}}
+	fake.lock.Unlock()
+
+	r.lock.Lock()
+	r.expires = time.Now()
+	r.lock.Unlock()
+
+	waitFor(t, func() bool {
+		addr, err := r.pick()
+		return err == nil && addr.String() == "c.internal:8082"
+	})
+}
+
+func TestSRVResolverTruncated(t *testing.T) {
+	fake := &fakeDNS{ttl: 60, truncate: true, records: map[string][]*srvRecord{
+		"_http._tcp.api.internal": {{target: "a.internal", port: 8080}},
+	}}
+	nameserver := fake.serve(t)
+
+	records, ttl, err := querySRV(nameserver, "_http._tcp.api.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0].target != "a.internal" || ttl != 60*time.Second {
+		t.Errorf("unexpected records %v with TTL %s", records, ttl)
+	}
+}
+
+func TestServiceSRV(t *testing.T) {
+	fake := &fakeDNS{ttl: 60, records: map[string][]*srvRecord{
+		"_http._tcp.api.internal": {{target: "a.internal", port: 8080}},
+	}}
+	nameserver := fake.serve(t)
+
+	s := newService()
+	if err := s.setSetting("srv", "_http._tcp.api.internal@"+nameserver); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := parseAddr("127.0.0.1:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setAddr("1", addr)
+
+	waitFor(t, func() bool {
+		picked, err := s.pick()
+		return err == nil && picked.String() == "a.internal:8080"
+	})
+
+	// Clones should share the cached records.
+	if c := s.clone(); c.srv != s.srv {
+		t.Error("clone doesn't share the resolver")
+	}
+
+	// Explicit addresses should be used when the name has no records.
+	if err := s.setSetting("srv", "_http._tcp.missing.internal@"+nameserver); err != nil {
+		t.Fatal(err)
+	}
+
+	if picked, err := s.pick(); err != nil || picked != addr {
+		t.Errorf("unexpected pick %v, %v", picked, err)
+	}
+
+	if err := s.setSetting("srv", "@"+nameserver); err == nil {
+		t.Error("no error reported for a srv setting without a name")
+	}
+}
+
+func TestSRVResolverWeights(t *testing.T) {
+	fake := &fakeDNS{ttl: 60, records: map[string][]*srvRecord{
+		"_http._tcp.api.internal": {
+			{weight: 0, target: "a.internal", port: 8080},
+			{weight: 0, target: "b.internal", port: 8081},
+		},
+		"_http._tcp.down.internal": {{target: ""}},
+	}}
+	nameserver := fake.serve(t)
+
+	// Targets should be picked even when every weight is 0.
+	r := newSRVResolver("_http._tcp.api.internal@" + nameserver)
+	picks := make(map[string]int)
+	waitFor(t, func() bool {
+		if addr, err := r.pick(); err == nil {
+			picks[addr.String()]++
+		}
+		return picks["a.internal:8080"] > 0 && picks["b.internal:8081"] > 0
+	})
+
+	// A target of "." means the service isn't available, even with explicit
+	// addresses.
+	s := newService()
+	if err := s.setSetting("srv", "_http._tcp.down.internal@"+nameserver); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := parseAddr("127.0.0.1:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setAddr("1", addr)
+
+	waitFor(t, func() bool {
+		_, err := s.pick()
+		return err == unavailableSRVError
+	})
+}
+
+func TestServiceSRVNonBlocking(t *testing.T) {
+
+	// Stand in for a nameserver that never answers.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := newService()
+	if err := s.setSetting("srv", "_http._tcp.api.internal@"+conn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := parseAddr("127.0.0.1:9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setAddr("1", addr)
+
+	start := time.Now()
+	if picked, err := s.pick(); err != nil || picked != addr {
+		t.Errorf("unexpected pick %v, %v", picked, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("pick waited %s for DNS", elapsed)
+	}
+}
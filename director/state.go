@@ -0,0 +1,440 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// keyState builds routing tables from configuration keys laid out according
+// to the key grammar, wherever those keys come from. Directors feed it either
+// single changes or complete sets of keys, and it publishes the result as an
+// immutable table.
+type keyState struct {
+	rootKey string
+
+	// table is the published routing snapshot. It's replaced atomically and
+	// never modified, so picking an address doesn't require any locks.
+	table atomic.Pointer[table]
+
+	// Updates are serialized by a mutex. The node index and the pending
+	// table are only accessed while holding it.
+	lock sync.Mutex
+
+	// nodes indexes the value of every leaf key that has been applied, so
+	// that deletions can be reversed exactly, even when only the key of a
+	// deleted directory is reported.
+	nodes map[string]string
+
+	// pending collects changes until they're published as a new table.
+	// keyAction only changes routing through it: nodes and rejected are kept
+	// by setKey, unsetKey and deleteKey, and committed only changes for the
+	// commit key. So when nothing was pending before a change, setting
+	// pending to nil undoes the change to the table, as MemoryDirector does
+	// with rejected values.
+	pending *tableBuilder
+
+	// committed records that the commit key changed since the last publish.
+	committed bool
+
+	// rejected holds the keys whose values couldn't be applied, and
+	// lastStatus the last report of them written back to the source.
+	rejected   map[string]*Rejection
+	lastStatus string
+
+	// SnapshotPath, if set, is a file the published configuration is saved
+	// to, and loaded from when watching starts. This lets the director serve
+	// traffic while its configuration source is unreachable. It should be set
+	// before calling Watch.
+	SnapshotPath string
+
+	// stale is set while serving a snapshot the source hasn't confirmed.
+	stale int32
+}
+
+func newKeyState(rootKey string) *keyState {
+	k := &keyState{
+		rootKey:  rootKey,
+		nodes:    make(map[string]string),
+		rejected: make(map[string]*Rejection),
+	}
+
+	k.table.Store(newTable())
+	return k
+}
+
+// builder returns the builder for pending changes, starting one from the
+// published table if necessary.
+func (k *keyState) builder() *tableBuilder {
+	if k.pending == nil {
+		k.pending = newTableBuilder(k.table.Load())
+	}
+	return k.pending
+}
+
+// reservedKeyPath returns the full key of a key reserved for the director's
+// own use.
+func (k *keyState) reservedKeyPath(name string) string {
+	return fmt.Sprintf("/%s/%s", strings.Trim(k.rootKey, "/"), name)
+}
+
+// commit publishes the pending changes, unless a commit key is present and
+// hasn't changed. While the commit key exists, writers can stage any number
+// of changes and then release them together by advancing the commit key's
+// value. Deleting the commit key publishes every change as it arrives again.
+func (k *keyState) commit() {
+	if _, transactional := k.nodes[k.reservedKeyPath(commitKey)]; !transactional || k.committed {
+		k.publish()
+	}
+	k.committed = false
+}
+
+// publish atomically replaces the routing table with the pending changes, if
+// there are any.
+func (k *keyState) publish() {
+	if k.pending != nil {
+		k.table.Store(k.pending.build())
+		k.pending = nil
+		k.saveSnapshot()
+	}
+}
+
+// saveSnapshot writes the published configuration to the snapshot path, if
+// one is set. It expects the caller to hold the lock.
+func (k *keyState) saveSnapshot() {
+	if k.SnapshotPath == "" {
+		return
+	}
+
+	if err := writeSnapshot(k.SnapshotPath, k.nodes); err != nil {
+		log.WithField("path", k.SnapshotPath).Error(err)
+	}
+}
+
+// confirmSnapshot saves the snapshot after the source confirmed the whole
+// configuration, even if nothing changed, so that the save time of the
+// snapshot reflects the confirmation. Unpublished changes wait for their
+// commit. It expects the caller to hold the lock.
+func (k *keyState) confirmSnapshot() {
+	if k.pending == nil {
+		k.saveSnapshot()
+	}
+}
+
+// loadSnapshot publishes the configuration saved at the snapshot path, marking
+// it as stale until the source confirms it. It returns the time the snapshot
+// was saved, the last time its configuration was confirmed, or the zero time
+// if there's no snapshot.
+func (k *keyState) loadSnapshot() time.Time {
+	if k.SnapshotPath == "" {
+		return time.Time{}
+	}
+
+	nodes, saved, err := readSnapshot(k.SnapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithField("path", k.SnapshotPath).Error(err)
+		}
+		return time.Time{}
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.reconcile(nodes)
+	k.publish()
+	atomic.StoreInt32(&k.stale, 1)
+	log.WithFields(log.Fields{"path": k.SnapshotPath, "keys": len(nodes), "saved": saved}).Warn("serving stale snapshot")
+	return saved
+}
+
+// confirm records that the routing table matches the source.
+func (k *keyState) confirm() {
+	atomic.StoreInt32(&k.stale, 0)
+}
+
+// Stale reports whether or not the routing table was loaded from the snapshot
+// and hasn't been confirmed by the source yet.
+func (k *keyState) Stale() bool {
+	return atomic.LoadInt32(&k.stale) == 1
+}
+
+func (k *keyState) processDomainService(dn, prefix, service string, add bool) {
+
+	// Get the domain and set a map of fields for logging.
+	d := k.builder().domain(dn)
+	fields := log.Fields{
+		"dn":      dn,
+		"prefix":  prefix,
+		"service": service,
+	}
+
+	// Check whether or not this action is additive.
+	if add {
+		d.setServicePrefix(prefix, service)
+		log.WithFields(fields).Debug("+ domain service prefix")
+	} else {
+		d.removeServicePrefix(prefix)
+		log.WithFields(fields).Debug("- domain service prefix")
+
+		k.builder().pruneDomain(dn)
+	}
+}
+
+func (k *keyState) processServiceAddr(sn, name string, addr net.Addr, add bool) {
+
+	// Get the domain and set a map of fields for logging.
+	s := k.builder().service(sn)
+	fields := log.Fields{
+		"sn":   sn,
+		"name": name,
+	}
+
+	// Check whether or not this action is additive.
+	if add {
+		s.setAddr(name, addr)
+		log.WithFields(fields).WithField("addr", addr.String()).Debug("+ service addr")
+	} else {
+		s.removeAddr(name)
+		log.WithFields(fields).Debug("- service addr")
+		k.builder().pruneService(sn)
+	}
+}
+
+func (k *keyState) processServiceSetting(sn, key, value string, add bool) error {
+
+	// Get the service and set a map of fields for logging.
+	s := k.builder().service(sn)
+	fields := log.Fields{
+		"sn":    sn,
+		"key":   key,
+		"value": value,
+	}
+
+	// Check whether or not this action is additive.
+	if add {
+		if err := s.setSetting(key, value); err != nil {
+			k.builder().pruneService(sn)
+			return err
+		}
+		log.WithFields(fields).Debug("+ service setting")
+	} else {
+		s.removeSetting(key)
+		log.WithFields(fields).Debug("- service setting")
+		k.builder().pruneService(sn)
+	}
+
+	return nil
+}
+
+func (k *keyState) processServiceNode(sn, detail, value string, add bool) error {
+
+	// Details starting with a dot are settings rather than addresses.
+	if strings.HasPrefix(detail, ".") {
+		return k.processServiceSetting(sn, strings.TrimPrefix(detail, "."), value, add)
+	}
+
+	// Removing an address only requires its name.
+	if !add {
+		k.processServiceAddr(sn, detail, nil, false)
+		return nil
+	}
+
+	// Parse the address.
+	addr, err := parseAddr(value)
+	if err != nil {
+		return err
+	}
+
+	// Process the service addr.
+	k.processServiceAddr(sn, detail, addr, true)
+	return nil
+}
+
+// keyAction applies or reverses the value of a key. Changes to routing only
+// go to the pending table builder.
+func (k *keyState) keyAction(key, value string, add bool) error {
+	parsedKey, err := parseKey(k.rootKey, key)
+	if err != nil {
+		return err
+	}
+
+	// Check what kind of key this is.
+	switch parsedKey.kind {
+	case domainsKind:
+		k.processDomainService(parsedKey.name, parsedKey.prefix, value, add)
+	case servicesKind:
+		return k.processServiceNode(parsedKey.name, parsedKey.detail, value, add)
+	case reservedKind:
+
+		// Changes to the commit key don't affect routing themselves, they only
+		// release staged changes. The status key is written by directors
+		// themselves.
+		if parsedKey.name == commitKey {
+			if add {
+				log.WithField("generation", value).Info("commit")
+			}
+			k.committed = true
+		}
+	}
+
+	return nil
+}
+
+// setKey applies a leaf value, first reversing the previous value of the key
+// if there was one. Values that can't be applied are recorded as rejected.
+func (k *keyState) setKey(key, value string) {
+	if previous, ok := k.nodes[key]; ok {
+		if previous == value {
+			return
+		}
+		k.unsetKey(key, previous)
+	}
+
+	k.nodes[key] = value
+	if err := k.keyAction(key, value, true); err != nil {
+		log.WithFields(log.Fields{"key": key, "value": value}).Warn(err)
+		k.rejected[key] = &Rejection{Key: key, Value: value, Reason: err.Error()}
+	}
+}
+
+// unsetKey reverses the value of a key, unless that value was rejected.
+func (k *keyState) unsetKey(key, value string) {
+	if _, ok := k.rejected[key]; ok {
+		delete(k.rejected, key)
+		return
+	}
+
+	k.keyAction(key, value, false)
+}
+
+// deleteKey reverses a leaf key, or every indexed key under a directory.
+func (k *keyState) deleteKey(key string) {
+	dirPrefix := strings.TrimSuffix(key, "/") + "/"
+	for indexedKey, value := range k.nodes {
+		if indexedKey == key || strings.HasPrefix(indexedKey, dirPrefix) {
+			delete(k.nodes, indexedKey)
+			k.unsetKey(indexedKey, value)
+		}
+	}
+}
+
+// reconcile applies only the differences between the indexed nodes and the
+// given complete set of nodes, so that unchanged domains and services keep
+// their state. It expects the caller to hold the lock.
+func (k *keyState) reconcile(nodes map[string]string) {
+	var added, changed, removed []string
+	for key := range k.nodes {
+		if _, ok := nodes[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	for key, value := range nodes {
+		if previous, ok := k.nodes[key]; !ok {
+			added = append(added, key)
+		} else if previous != value {
+			changed = append(changed, key)
+		}
+	}
+
+	// Apply the changes in a stable order, starting with removals.
+	sort.Strings(removed)
+	for _, key := range removed {
+		k.deleteKey(key)
+	}
+
+	sort.Strings(changed)
+	sort.Strings(added)
+	for _, key := range append(changed, added...) {
+		k.setKey(key, nodes[key])
+	}
+
+	log.WithFields(log.Fields{
+		"prefix":  k.rootKey,
+		"added":   len(added),
+		"changed": len(changed),
+		"removed": len(removed),
+	}).Info("reconcile")
+}
+
+// rejections returns the rejected keys, sorted by key. It expects the caller
+// to hold the lock.
+func (k *keyState) rejections() []*Rejection {
+	rejections := make([]*Rejection, 0, len(k.rejected))
+	for _, rejection := range k.rejected {
+		rejections = append(rejections, rejection)
+	}
+
+	sort.Slice(rejections, func(i, j int) bool {
+		return rejections[i].Key < rejections[j].Key
+	})
+
+	return rejections
+}
+
+// Rejections returns the keys whose values couldn't be applied, along with
+// the reasons, sorted by key.
+func (k *keyState) Rejections() []*Rejection {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.rejections()
+}
+
+// statusUpdate returns the JSON report of rejected keys, and whether or not
+// it changed since the last report.
+func (k *keyState) statusUpdate() (string, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	status, err := json.Marshal(struct {
+		Rejected []*Rejection `json:"rejected"`
+	}{k.rejections()})
+	if err != nil {
+		return "", false
+	}
+
+	changed := string(status) != k.lastStatus
+	k.lastStatus = string(status)
+	return k.lastStatus, changed
+}
+
+// statusFailed forgets the last report after it couldn't be written, so that
+// it's written again after the next update.
+func (k *keyState) statusFailed() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.lastStatus = ""
+}
+
+// Table describes the published routing table.
+func (k *keyState) Table() *TableView {
+	return k.table.Load().view()
+}
+
+// Pick attempts to match a hostname/path combination with the address of a
+// server that can handle the request.
+func (k *keyState) Pick(hostname, path string) (*Endpoint, error) {
+	return k.table.Load().pick(hostname, path)
+}
+
+// PickService returns the address of a server of the named service.
+func (k *keyState) PickService(name string) (*Endpoint, error) {
+	return k.table.Load().pickService(name)
+}
+
+// HasService reports whether or not the published table defines the named
+// service.
+func (k *keyState) HasService(name string) bool {
+	return k.table.Load().hasService(name)
+}
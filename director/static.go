@@ -0,0 +1,31 @@
+package director
+
+import (
+	"net"
+)
+
+// staticDirector routes every request to a single address, without
+// publishing a routing table.
+type staticDirector struct {
+	addr net.Addr
+}
+
+// NewStaticDirector returns a director routing every request and service to
+// the address.
+func NewStaticDirector(addr net.Addr) *staticDirector {
+	return &staticDirector{addr: addr}
+}
+
+func (s *staticDirector) Pick(hostname, path string) (*Endpoint, error) {
+	return &Endpoint{Service: "static", Addr: s.addr}, nil
+}
+
+func (s *staticDirector) PickService(name string) (*Endpoint, error) {
+	return &Endpoint{Service: name, Addr: s.addr}, nil
+}
+
+// HasService reports that every service is defined, since they all route to
+// the address.
+func (s *staticDirector) HasService(name string) bool {
+	return true
+}
@@ -0,0 +1,128 @@
+package director
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SyncReporter is implemented by directors that watch a configuration source
+// and can report how current their routing table is.
+type SyncReporter interface {
+	SyncState() SyncState
+
+	// LastConfirmed returns the last time the routing table was known to
+	// match the configuration source, because the director read it or heard
+	// from a watch on it. It's the zero time if the table has never been
+	// confirmed.
+	LastConfirmed() time.Time
+}
+
+// SyncState describes how current a director's routing table is.
+type SyncState int32
+
+const (
+
+	// SyncStarting means no configuration has been loaded yet.
+	SyncStarting SyncState = iota
+
+	// SyncCurrent means the director is watching for updates.
+	SyncCurrent
+
+	// SyncResyncing means the director is reloading its configuration after
+	// falling behind the update history.
+	SyncResyncing
+
+	// SyncBackoff means the director is waiting to retry after an error.
+	SyncBackoff
+)
+
+func (s SyncState) String() string {
+	switch s {
+	case SyncStarting:
+		return "starting"
+	case SyncCurrent:
+		return "current"
+	case SyncResyncing:
+		return "resyncing"
+	case SyncBackoff:
+		return "backoff"
+	}
+	return "unknown"
+}
+
+// syncTracker implements SyncReporter for directors to embed.
+type syncTracker struct {
+
+	// name identifies the director in logs.
+	name string
+
+	// state holds the current SyncState, and confirmed the time, in
+	// nanoseconds, the routing table was last known to match the source.
+	state     int32
+	confirmed int64
+}
+
+// setSyncState records and logs changes to the sync state.
+func (t *syncTracker) setSyncState(state SyncState) {
+	if previous := SyncState(atomic.SwapInt32(&t.state, int32(state))); previous != state {
+		log.WithFields(log.Fields{"prefix": t.name, "from": previous, "to": state}).Info("sync state")
+	}
+}
+
+// markConfirmed records that the routing table was just known to match the
+// source.
+func (t *syncTracker) markConfirmed() {
+	t.confirmedAt(time.Now())
+}
+
+// confirmedAt records that the routing table matched the source at the given
+// time, unless it has been confirmed since. The zero time is ignored.
+func (t *syncTracker) confirmedAt(at time.Time) {
+	if at.IsZero() {
+		return
+	}
+
+	for {
+		confirmed := atomic.LoadInt64(&t.confirmed)
+		if confirmed >= at.UnixNano() || atomic.CompareAndSwapInt64(&t.confirmed, confirmed, at.UnixNano()) {
+			return
+		}
+	}
+}
+
+// LastConfirmed returns the last time the routing table was known to match
+// the configuration source.
+func (t *syncTracker) LastConfirmed() time.Time {
+	if confirmed := atomic.LoadInt64(&t.confirmed); confirmed != 0 {
+		return time.Unix(0, confirmed)
+	}
+	return time.Time{}
+}
+
+// SyncState reports whether the director is currently watching its
+// configuration source, or recovering from an error.
+func (t *syncTracker) SyncState() SyncState {
+	return SyncState(atomic.LoadInt32(&t.state))
+}
+
+// newStats returns the expvar statistics of a watching director, published
+// in the parent map under its root key. The map reports the director's sync
+// state, whether its routing table is stale, and how many keys it rejected,
+// and directors add their own counters to it.
+func newStats(parent *expvar.Map, k *keyState, t *syncTracker) *expvar.Map {
+	stats := new(expvar.Map).Init()
+	stats.Set("sync_state", expvar.Func(func() interface{} {
+		return t.SyncState().String()
+	}))
+	stats.Set("stale", expvar.Func(func() interface{} {
+		return k.Stale()
+	}))
+	stats.Set("rejected", expvar.Func(func() interface{} {
+		return len(k.Rejections())
+	}))
+	parent.Set(k.rootKey, stats)
+	return stats
+}
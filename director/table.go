@@ -0,0 +1,200 @@
+package director
+
+import (
+	"strings"
+)
+
+// table is a snapshot of routing information. Once published, a table is
+// never modified, so it can be read without any locks.
+type table struct {
+	domains  map[string]*domain
+	services map[string]*service
+}
+
+func newTable() *table {
+	return &table{
+		domains:  make(map[string]*domain),
+		services: make(map[string]*service),
+	}
+}
+
+// pick attempts to match a hostname/path combination with the address of a
+// server that can handle the request.
+func (t *table) pick(hostname, path string) (*Endpoint, error) {
+	domain := t.domains[hostname]
+	if domain == nil {
+		return nil, undefinedDomainError
+	}
+
+	prefix, serviceName, err := domain.route(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := t.pickService(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint.Prefix = prefix
+	return endpoint, nil
+}
+
+// pickService returns the address of a server of the named service.
+func (t *table) pickService(name string) (*Endpoint, error) {
+	service := t.services[name]
+	if service == nil {
+		return nil, undefinedServiceError
+	}
+
+	addr, err := service.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Endpoint{
+		Service: name,
+		Addr:    addr,
+		Config:  service.config,
+	}, nil
+}
+
+// hasService reports whether or not the table defines the named service.
+func (t *table) hasService(name string) bool {
+	return t.services[name] != nil
+}
+
+// TableView describes a routing table for inspection. Its JSON form is also
+// a valid routing file, apart from any conflicts.
+type TableView struct {
+	Domains   map[string]map[string]string `json:"domains"`
+	Services  map[string]*ServiceView      `json:"services"`
+	Conflicts []string                     `json:"conflicts,omitempty"`
+}
+
+// ServiceView describes the addresses and settings of a service.
+type ServiceView struct {
+	Addrs    map[string]string `json:"addrs"`
+	Settings map[string]string `json:"settings"`
+}
+
+// Inspector is implemented by directors that can describe their routing
+// table.
+type Inspector interface {
+	Table() *TableView
+}
+
+// view describes the table.
+func (t *table) view() *TableView {
+	view := &TableView{
+		Domains:  make(map[string]map[string]string, len(t.domains)),
+		Services: make(map[string]*ServiceView, len(t.services)),
+	}
+
+	for dn, d := range t.domains {
+		prefixes := make(map[string]string, len(d.services.prefixes))
+		for prefix, service := range d.services.prefixes {
+			prefixes[prefix] = service
+		}
+		view.Domains[dn] = prefixes
+	}
+
+	for sn, s := range t.services {
+		sv := &ServiceView{
+			Addrs:    make(map[string]string, len(s.addrs)),
+			Settings: make(map[string]string, len(s.settings)),
+		}
+		for name, addr := range s.addrs {
+			if addr.Network() == "unix" {
+				sv.Addrs[name] = unixAddrPrefix + addr.String()
+			} else {
+				sv.Addrs[name] = addr.String()
+			}
+		}
+		for key, value := range s.settings {
+			sv.Settings[key] = value
+		}
+		view.Services[sn] = sv
+	}
+
+	return view
+}
+
+// tableBuilder makes copy-on-write changes to a table. Domains and services
+// are copied the first time they're changed, so the table being built never
+// shares mutable state with a published one.
+type tableBuilder struct {
+	table          *table
+	copiedDomains  map[string]bool
+	copiedServices map[string]bool
+}
+
+func newTableBuilder(base *table) *tableBuilder {
+	b := &tableBuilder{
+		table:          newTable(),
+		copiedDomains:  make(map[string]bool),
+		copiedServices: make(map[string]bool),
+	}
+
+	for name, d := range base.domains {
+		b.table.domains[name] = d
+	}
+
+	for name, s := range base.services {
+		b.table.services[name] = s
+	}
+
+	return b
+}
+
+// domain returns a changeable domain of the given name, creating it if it's
+// missing.
+func (b *tableBuilder) domain(name string) *domain {
+	if !b.copiedDomains[name] {
+		if d, ok := b.table.domains[name]; ok {
+			b.table.domains[name] = d.clone()
+		} else {
+			b.table.domains[name] = newDomain()
+		}
+		b.copiedDomains[name] = true
+	}
+
+	return b.table.domains[name]
+}
+
+// service returns a changeable service of the given name, creating it if it's
+// missing.
+func (b *tableBuilder) service(name string) *service {
+	if !b.copiedServices[name] {
+		if s, ok := b.table.services[name]; ok {
+			b.table.services[name] = s.clone()
+		} else {
+			b.table.services[name] = newService()
+		}
+		b.copiedServices[name] = true
+	}
+
+	return b.table.services[name]
+}
+
+// pruneDomain removes the named domain once it has no prefixes left.
+func (b *tableBuilder) pruneDomain(name string) {
+	if d, ok := b.table.domains[name]; ok && d.empty() {
+		delete(b.table.domains, name)
+		delete(b.copiedDomains, name)
+	}
+}
+
+// pruneService removes the named service once it has no addresses or
+// settings left.
+func (b *tableBuilder) pruneService(name string) {
+	if s, ok := b.table.services[name]; ok && s.empty() {
+		delete(b.table.services, name)
+		delete(b.copiedServices, name)
+	}
+}
+
+// build returns the finished table. The builder must not be used afterwards.
+func (b *tableBuilder) build() *table {
+	return b.table
+}
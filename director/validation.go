@@ -0,0 +1,24 @@
+package director
+
+import (
+	"fmt"
+)
+
+// Rejection describes a configuration key that was ignored because its value
+// couldn't be applied.
+type Rejection struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// Validator is implemented by directors that report the configuration keys
+// they rejected.
+type Validator interface {
+	Rejections() []*Rejection
+}
+
+// Error describes the rejection, so it can be returned as an error.
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s: %s", r.Key, r.Reason)
+}
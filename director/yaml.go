@@ -0,0 +1,233 @@
+package director
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a line of a YAML document holding a mapping entry, without its
+// indentation or comment.
+type yamlLine struct {
+	number  int
+	indent  int
+	content string
+}
+
+// parseYAML parses the subset of YAML routing files are written in, rather
+// than depending on a full YAML library. A document is a block mapping, and
+// every line holds one entry of a block mapping, indented with spaces:
+//
+//	key: value
+//	key:
+//	  nested: value
+//
+// Keys are plain, or single or double quoted. Values are one of:
+//
+//   - a plain scalar, kept as a string even when it looks like a number or a
+//     boolean, so "10" and "true" reach the settings unchanged
+//   - a single quoted scalar, where two quotes in a row stand for one
+//   - a double quoted scalar, using Go's escape sequences, which cover the
+//     common YAML ones but not \e, \N, \_, \L, \P or an escaped space
+//   - ~, null, Null, NULL or nothing at all, for null
+//   - {}, the empty mapping
+//   - nothing, with a nested block mapping indented on the following lines
+//
+// Blank lines, comments starting with a # at the start of a line or after a
+// space, and a --- marker before the first entry are ignored. Everything
+// else is rejected with the number of the offending line: tabs in the
+// indentation, block and flow sequences, flow mappings other than {},
+// anchors, aliases, tags, block scalars (| and >), directives, the reserved
+// indicators @ and `, scalars spanning several lines, duplicate keys,
+// indentation that doesn't match an enclosing mapping, entries without a
+// colon and a space, text after a quoted scalar, unterminated quotes, and
+// further documents.
+//
+// Mappings are returned as map[string]interface{}, scalars as strings, and
+// null values as nil, so the result can be encoded as JSON.
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []*yamlLine
+	for i, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(stripYAMLComment(text), " \r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || (len(lines) == 0 && content == "---") {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs can't be used for indentation", i+1)
+		}
+		lines = append(lines, &yamlLine{number: i + 1, indent: len(text) - len(content), content: content})
+	}
+
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	p := &yamlParser{lines: lines}
+	value, err := p.mapping(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(lines) {
+		return nil, fmt.Errorf("yaml: line %d: unexpected indentation", lines[p.next].number)
+	}
+	return value, nil
+}
+
+// stripYAMLComment removes a comment, which starts with a # at the start of
+// the line or after a space, outside of quotes.
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+type yamlParser struct {
+	lines []*yamlLine
+	next  int
+}
+
+// mapping parses the entries of a block mapping at the indentation.
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.next < len(p.lines) && p.lines[p.next].indent == indent {
+		line := p.lines[p.next]
+		p.next++
+
+		key, rest, err := yamlKey(line)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("yaml: line %d: duplicate key %q", line.number, key)
+		}
+
+		// A key without a value holds either a nested mapping, on the
+		// following lines, or null.
+		if rest == "" {
+			if p.next < len(p.lines) && p.lines[p.next].indent > indent {
+				if m[key], err = p.mapping(p.lines[p.next].indent); err != nil {
+					return nil, err
+				}
+			} else {
+				m[key] = nil
+			}
+			continue
+		}
+
+		if m[key], err = yamlScalar(line, rest); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// yamlKey splits a mapping entry into its key and the rest of the line.
+func yamlKey(line *yamlLine) (string, string, error) {
+	content := line.content
+	if content == "-" || strings.HasPrefix(content, "- ") {
+		return "", "", fmt.Errorf("yaml: line %d: sequences aren't supported", line.number)
+	}
+
+	var key, rest string
+	if content[0] == '"' || content[0] == '\'' {
+		end := quotedEnd(content)
+		if end < 0 {
+			return "", "", fmt.Errorf("yaml: line %d: unterminated quoted key", line.number)
+		}
+
+		var err error
+		if key, err = unquoteYAML(content[:end]); err != nil {
+			return "", "", fmt.Errorf("yaml: line %d: %s", line.number, err)
+		}
+		rest = content[end:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("yaml: line %d: expected a colon after the key", line.number)
+		}
+		rest = rest[1:]
+	} else {
+		i := strings.Index(content, ": ")
+		switch {
+		case i >= 0:
+			key, rest = content[:i], content[i+1:]
+		case strings.HasSuffix(content, ":"):
+			key = strings.TrimSuffix(content, ":")
+		default:
+			return "", "", fmt.Errorf("yaml: line %d: expected a key and a colon", line.number)
+		}
+		key = strings.TrimRight(key, " ")
+	}
+
+	if rest != "" && rest[0] != ' ' {
+		return "", "", fmt.Errorf("yaml: line %d: expected a space after the colon", line.number)
+	}
+	return key, strings.TrimSpace(rest), nil
+}
+
+// yamlScalar parses the value of a mapping entry given on the same line.
+func yamlScalar(line *yamlLine, value string) (interface{}, error) {
+	switch value[0] {
+	case '"', '\'':
+		if quotedEnd(value) != len(value) {
+			return nil, fmt.Errorf("yaml: line %d: unexpected text after the quoted value", line.number)
+		}
+		s, err := unquoteYAML(value)
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: %s", line.number, err)
+		}
+		return s, nil
+	case '{':
+		if strings.TrimSpace(value[1:]) == "}" {
+			return map[string]interface{}{}, nil
+		}
+		return nil, fmt.Errorf("yaml: line %d: flow mappings aren't supported", line.number)
+	case '[', '&', '*', '!', '|', '>', '%', '@', '`':
+		return nil, fmt.Errorf("yaml: line %d: unsupported value %q", line.number, value)
+	}
+
+	switch value {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	}
+	return value, nil
+}
+
+// quotedEnd returns the index just past the closing quote of the quoted
+// string s starts with, or -1 if it's never closed.
+func quotedEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// unquoteYAML returns the value of a single or double quoted string.
+// Double quoted strings use Go's escape sequences, which cover YAML's common
+// ones.
+func unquoteYAML(s string) (string, error) {
+	if s[0] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return strconv.Unquote(s)
+}
@@ -0,0 +1,68 @@
+package director
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	value, err := parseYAML([]byte(`
+a:
+  b: plain value # comment
+  "c: d": "quoted # not a comment"
+  'e': 'it''s'
+  f:
+  g: {}
+  h: ~
+i: "tab\tescape"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b":    "plain value",
+			"c: d": "quoted # not a comment",
+			"e":    "it's",
+			"f":    nil,
+			"g":    map[string]interface{}{},
+			"h":    nil,
+		},
+		"i": "tab\tescape",
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Errorf("unexpected value %#v", value)
+	}
+
+	for _, invalid := range []string{
+		"a:\n\tb: c\n",           // tab indentation
+		"a:\n  - b\n",            // block sequence
+		"- a\n",                  // top-level sequence
+		"a: [b]\n",               // flow sequence
+		"a: {b: c}\n",            // flow mapping
+		"a: &anchor b\n",         // anchor
+		"a: *alias\n",            // alias
+		"a: !tag b\n",            // tag
+		"a: |\n  b\n",            // literal block scalar
+		"a: >\n  b\n",            // folded block scalar
+		"%YAML 1.2\n---\na: b\n", // directive
+		"a: @b\n",                // reserved indicator
+		"a: `b`\n",               // reserved indicator
+		"a: b\n  c\n",            // multi-line scalar
+		"a: b\na: c\n",           // duplicate key
+		"a:\n    b: c\n  d: e\n", // unmatched indentation
+		"a b\n",                  // missing colon
+		"a:b\n",                  // missing space after colon
+		"\"a: b\n",               // unterminated quoted key
+		"a: 'b' c\n",             // text after quoted value
+		"a: \"b\n",               // unterminated quoted value
+		"a: \"\\e\"\n",           // YAML-only escape
+		"a: b\n---\nc: d\n",      // second document
+		"plain\n",                // top-level scalar
+	} {
+		if _, err := parseYAML([]byte(invalid)); err == nil {
+			t.Errorf("%q: no error reported", invalid)
+		}
+	}
+}
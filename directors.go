@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+// newDirector opens a director for the prefix and starts watching for
+// updates. The prefix names either an etcd or Consul key or, with a routes
+// directory, a routing file in it. With several layers, their directors are
+// merged, later layers taking precedence.
+func newDirector(prefix string) director.Director {
+	if !prefixValidator.Match([]byte(prefix)) {
+		log.Fatalf("prefix is invalid: %s", prefix)
+	}
+
+	sources := strings.Split(layers, ",")
+	if layers == "" {
+		switch {
+		case routesDir != "":
+			sources = []string{"file"}
+		case consulAddr != "":
+			sources = []string{"consul"}
+		default:
+			sources = []string{"etcd"}
+		}
+	}
+
+	directors := make([]director.Director, len(sources))
+	for i, source := range sources {
+		directors[i] = openDirector(sourceURL(source, prefix), snapshotPath(source, prefix))
+	}
+
+	if len(directors) == 1 {
+		return directors[0]
+	}
+	return director.NewCompositeDirector(directors...)
+}
+
+// newListenerDirector creates the director of a listener, which reads either
+// a single prefix or several joined by "+", such as
+// promise/shared+promise/elections. Later prefixes override and add to
+// earlier ones. Each prefix may instead be a URL naming its configuration
+// source, such as etcd://127.0.0.1:4001/promise.
+func newListenerDirector(prefixes string) director.Director {
+	var directors []director.Director
+	for _, prefix := range strings.Split(prefixes, "+") {
+		if strings.Contains(prefix, ":") {
+			directors = append(directors, openDirector(prefix, snapshotPath("url", prefix)))
+		} else {
+			directors = append(directors, newDirector(prefix))
+		}
+	}
+
+	if len(directors) == 1 {
+		return directors[0]
+	}
+	return director.NewCompositeDirector(directors...)
+}
+
+// sourceURL returns the director URL of the prefix in a single configuration
+// source. etcd and Consul URLs leave their hosts to the -C and -consul flags.
+func sourceURL(source, prefix string) string {
+	switch source {
+	case "file":
+		path, err := routesFile(routesDir, prefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return (&url.URL{Scheme: "file", Path: path}).String()
+	case "consul":
+		return "consul:///" + prefix
+	case "etcd":
+		switch etcdAPI {
+		case "v2":
+			return "etcd:///" + prefix
+		case "v3":
+			return "etcd3:///" + prefix
+		}
+
+		log.Fatalf("etcd API version is invalid: %s", etcdAPI)
+	}
+
+	log.Fatalf("configuration source is invalid: %s", source)
+	return ""
+}
+
+// routesFileExtensions are the extensions of routing files in a routes
+// directory, in the order they're looked for.
+var routesFileExtensions = []string{".json", ".yaml", ".yml"}
+
+// routesFile returns the absolute path of the routing file of the prefix in
+// the directory, the first of prefix.json, prefix.yaml and prefix.yml that
+// exists.
+func routesFile(dir, prefix string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ext := range routesFileExtensions {
+		path := filepath.Join(dir, prefix+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("no routing file for prefix %s in %s, expected %s.json, %s.yaml or %s.yml", prefix, dir, prefix, prefix, prefix)
+}
+
+// openDirector creates a director from a URL through the director registry,
+// and starts watching for updates. Directors of the same etcd machines share
+// a single watch.
+func openDirector(rawurl, snapshotPath string) director.Director {
+	options := &director.Options{
+		BatchWindow:  batchWindow,
+		WriteStatus:  writeStatus,
+		SnapshotPath: snapshotPath,
+		EtcdMachines: strings.Split(etcdPeers, ","),
+		ConsulAddr:   consulAddr,
+	}
+
+	d, err := director.Open(rawurl, options)
+	if err != nil {
+		log.Fatalf("director URL %s is invalid: %s", rawurl, err)
+	}
+	return d
+}
+
+// snapshotPath returns the file to save the routing snapshots of the prefix
+// in, if a snapshot directory is set. Sources other than etcd get their own
+// files, so layering them doesn't overwrite etcd's snapshots. Prefixes given
+// as URLs are named after the whole URL.
+func snapshotPath(source, prefix string) string {
+	if snapshotDir == "" {
+		return ""
+	}
+	if source != "etcd" && source != "url" {
+		prefix = source + ":" + prefix
+	}
+	return filepath.Join(snapshotDir, url.PathEscape(prefix)+".json")
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoutesFile(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := routesFile(dir, "promise"); err == nil {
+		t.Error("no error reported for a missing routing file")
+	}
+
+	// YAML files are found, but JSON ones take precedence.
+	for _, name := range []string{"promise.yml", "promise.yaml", "promise.json"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if found, err := routesFile(dir, "promise"); err != nil || found != path {
+			t.Errorf("expected %s, got %s, %v", path, found, err)
+		}
+	}
+}
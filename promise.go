@@ -2,27 +2,58 @@ package main // import "github.com/newsdev/promise"
 
 import (
 	"flag"
-	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/newsdev/promise/director"
+	"github.com/newsdev/promise/router"
 )
 
 var (
-	listenerPairs, etcdPeers string
-	enableCompression        bool
-	prefixValidator          *regexp.Regexp
+	listenerPairs, tcpListenerTriples, etcdPeers   string
+	etcdAPI, consulAddr, layers                    string
+	adminAddr, snapshotDir, staleHeader, routesDir string
+	enableCompression, writeStatus                 bool
+	batchWindow, staleAfter                        time.Duration
+	prefixValidator                                *regexp.Regexp
 )
 
 func init() {
 	prefixValidator = regexp.MustCompile(`^\w+(\/\w+)*$`)
-	flag.StringVar(&listenerPairs, "listeners", "promise:80", "etcd prefix/address pairs to setup listners")
+	flag.StringVar(&listenerPairs, "listeners", "promise:80", "etcd prefix/address pairs to setup listners, where several prefixes joined by + are layered, e.g. promise/shared+promise/elections:80, and a prefix can be a director URL such as etcd://127.0.0.1:4001/promise, etcd://10.0.0.1:4001;10.0.0.2:4001/promise, file:///etc/promise/routes.yaml or static:127.0.0.1:8080, where etcd URLs without a host read the -C machines")
+	flag.StringVar(&tcpListenerTriples, "tcp-listeners", "", "etcd prefix/service/address triples to setup raw TCP listeners, e.g. promise:redis:6379")
 	flag.StringVar(&etcdPeers, "C", "http://127.0.0.1:4001", "a comma-delimited list of machine addresses in the etcd cluster")
+	flag.StringVar(&etcdAPI, "etcd-api", "v2", "etcd API version to read the configuration with, v2 or v3")
 	flag.BoolVar(&enableCompression, "z", false, "enable transport compresssion")
+	flag.BoolVar(&writeStatus, "write-status", false, "report rejected configuration keys in the .status key under each etcd prefix")
+	flag.DurationVar(&batchWindow, "batch-window", director.DefaultBatchWindow, "time to wait for further etcd updates before applying them together")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "directory to save routing snapshots in, for starting while etcd is unreachable")
+	flag.DurationVar(&staleAfter, "stale-after", 0, "time after which an unconfirmed routing table is considered stale, or 0 to never")
+	flag.StringVar(&staleHeader, "stale-header", "", "response header added while the routing table is stale")
+	flag.StringVar(&consulAddr, "consul", "", "address of a Consul agent, such as http://127.0.0.1:8500, to route from instead of etcd")
+	flag.StringVar(&routesDir, "routes-dir", "", "directory of routing files, one per prefix such as promise.json, promise.yaml or promise.yml, looked for in that order, to route from instead of etcd; TOML isn't supported")
+	flag.StringVar(&layers, "layers", "", "comma-delimited configuration sources to merge for every prefix, later ones taking precedence, e.g. file,etcd,consul")
+	flag.StringVar(&adminAddr, "admin", "", "address for the admin listener serving /ready, /rejected, /table and /debug/vars")
+}
+
+// splitLast splits s into at most n substrings separated by sep, splitting at
+// the last separators first. The first substring holds the rest of s.
+func splitLast(s, sep string, n int) []string {
+	components := make([]string, n)
+	for n > 1 {
+		i := strings.LastIndex(s, sep)
+		if i < 0 {
+			return append([]string{s}, components[n:]...)
+		}
+		n--
+		components[n] = s[i+len(sep):]
+		s = s[:i]
+	}
+	components[0] = s
+	return components
 }
 
 func main() {
@@ -32,70 +63,72 @@ func main() {
 
 	errChan := make(chan error)
 
-	machines := strings.Split(etcdPeers, ",")
+	// Track the status of every listener's director.
+	board := newStatusBoard(staleAfter, staleHeader)
+	if staleAfter > 0 {
+		go board.monitor(time.Second)
+	}
 
 	for _, listenerPair := range strings.Split(listenerPairs, ",") {
 		log.Info(listenerPair)
 
-		listenerPairComponents := strings.Split(listenerPair, ":")
+		// The port follows the last colon, so prefixes can be URLs.
+		listenerPairComponents := splitLast(listenerPair, ":", 2)
+		if len(listenerPairComponents) != 2 {
+			log.Fatalf("listener is invalid: %s", listenerPair)
+		}
 
-		prefix := listenerPairComponents[0]
+		// Create a new director.
+		d := newListenerDirector(listenerPairComponents[0])
+		board.add(listenerPair, d)
 
-		if !prefixValidator.Match([]byte(prefix)) {
-			log.Fatalf("prefix is invalid: %s", prefix)
+		// Every request should hit the router, marked while the listener's
+		// routing table is stale.
+		stale := func(h http.Handler) http.Handler {
+			return board.handler(listenerPair, d, h)
 		}
+		r := router.New(d, router.WithCompression(enableCompression), router.WithMiddleware(stale))
 
-		port := listenerPairComponents[1]
+		addr := ":" + listenerPairComponents[1]
+		go func() {
+			errChan <- r.ListenAndServe(addr)
+		}()
+	}
 
-		// Create a new director.
-		d := director.NewEtcdDirector(prefix, machines)
-		go d.Watch()
-
-		// Build a custom ReverseProxy object.
-		reverseProxy := &httputil.ReverseProxy{
-			Transport: &http.Transport{
-				DisableCompression: !enableCompression,
-			},
-			Director: func(req *http.Request) {
-
-				// Get an address from the director. If an error occurs, we're just
-				// allowing an empty URL value in the request to pass through. The idea
-				// is to trigger an error and not allow arbitrary proxying of hosts we
-				// do not know about, but it's a less than ideal solution.
-				addr, err := d.Pick(req.Host, req.URL.Path)
-				if err != nil {
-					log.WithFields(log.Fields{"host": req.Host, "path": req.URL.Path}).Error(err)
-					return
-				}
-
-				// Set the missing portions of the URL.
-				req.URL.Scheme = "http"
-				req.URL.Host = addr.String()
-			},
-		}
+	if tcpListenerTriples != "" {
+		for _, tcpListenerTriple := range strings.Split(tcpListenerTriples, ",") {
+			log.Info(tcpListenerTriple)
 
-		// Every other request should hit the reverse proxy.
+			tcpListenerTripleComponents := splitLast(tcpListenerTriple, ":", 3)
+			if len(tcpListenerTripleComponents) != 3 {
+				log.Fatalf("tcp listener is invalid: %s", tcpListenerTriple)
+			}
 
-		mux := http.NewServeMux()
-		mux.Handle("/", reverseProxy)
+			// Create a new director.
+			d := newListenerDirector(tcpListenerTripleComponents[0])
+			board.add(tcpListenerTriple, d)
 
-		addr := fmt.Sprintf(":%s", port)
+			proxy := router.NewTCPProxy(d, tcpListenerTripleComponents[1])
 
-		server := &http.Server{
-			Addr:    addr,
-			Handler: mux,
+			addr := ":" + tcpListenerTripleComponents[2]
+			go func() {
+				errChan <- proxy.ListenAndServe(addr)
+			}()
 		}
+	}
 
-		go func() {
-			log.Infof("Listening at %s", addr)
-			errChan <- server.ListenAndServe()
+	// The admin listener serves the default mux, where expvar publishes its
+	// statistics.
+	if adminAddr != "" {
+		http.HandleFunc("/ready", board.serveReady)
+		http.HandleFunc("/rejected", board.serveRejected)
+		http.HandleFunc("/table", board.serveTable)
 
+		go func() {
+			log.Infof("Admin listening at %s", adminAddr)
+			errChan <- http.ListenAndServe(adminAddr, nil)
 		}()
-
-		// log.Fatal(http.ListenAndServe(addr, nil))
-
 	}
 
 	log.Fatal(<-errChan)
-
 }
@@ -0,0 +1,350 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+// FastCGI record types and constants, as described in the FastCGI
+// specification.
+const (
+	fcgiVersion1      = 1
+	fcgiBeginRequest  = 1
+	fcgiEndRequest    = 3
+	fcgiParams        = 4
+	fcgiStdin         = 5
+	fcgiStdout        = 6
+	fcgiStderr        = 7
+	fcgiResponder     = 1
+	fcgiRequestID     = 1
+	fcgiMaxContentLen = 65535
+)
+
+var (
+	fcgiVersionError = errors.New("unsupported FastCGI record version")
+)
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// fcgiConn writes and reads the records of a single FastCGI request.
+type fcgiConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *fcgiConn) writeRecord(recType uint8, content []byte) error {
+	header := fcgiHeader{
+		Version:       fcgiVersion1,
+		Type:          recType,
+		RequestID:     fcgiRequestID,
+		ContentLength: uint16(len(content)),
+		PaddingLength: uint8(-len(content) & 7),
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	buf.Write(content)
+	buf.Write(make([]byte, header.PaddingLength))
+
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeStream writes the content as a stream of records of the given type,
+// terminated by an empty record.
+func (c *fcgiConn) writeStream(recType uint8, r io.Reader) error {
+	buf := make([]byte, fcgiMaxContentLen)
+	for r != nil {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := c.writeRecord(recType, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.writeRecord(recType, nil)
+}
+
+func (c *fcgiConn) readRecord() (uint8, []byte, error) {
+	var header fcgiHeader
+	if err := binary.Read(c.r, binary.BigEndian, &header); err != nil {
+		return 0, nil, err
+	}
+
+	if header.Version != fcgiVersion1 {
+		return 0, nil, fcgiVersionError
+	}
+
+	content := make([]byte, int(header.ContentLength)+int(header.PaddingLength))
+	if _, err := io.ReadFull(c.r, content); err != nil {
+		return 0, nil, err
+	}
+
+	return header.Type, content[:header.ContentLength], nil
+}
+
+// encodeParams encodes name-value pairs in the FastCGI format.
+func encodeParams(params map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	writeLength := func(n int) {
+		if n < 128 {
+			buf.WriteByte(byte(n))
+		} else {
+			binary.Write(buf, binary.BigEndian, uint32(n)|1<<31)
+		}
+	}
+
+	for name, value := range params {
+		writeLength(len(name))
+		writeLength(len(value))
+		buf.WriteString(name)
+		buf.WriteString(value)
+	}
+
+	return buf.Bytes()
+}
+
+// fcgiParamsFor builds the CGI environment for a request. The route prefix
+// becomes SCRIPT_NAME and the rest of the path PATH_INFO, unless an index
+// script is configured, in which case the index is appended to the script
+// name. A prefix that doesn't end at a path segment boundary of the request,
+// such as app for /application, isn't a script name: the whole path is then
+// PATH_INFO.
+func fcgiParamsFor(req *http.Request, endpoint *director.Endpoint) map[string]string {
+	scriptName := "/" + strings.TrimSuffix(endpoint.Prefix, "/")
+	pathInfo := strings.TrimPrefix(req.URL.Path, scriptName)
+	if scriptName == "/" || pathInfo == req.URL.Path || (pathInfo != "" && pathInfo[0] != '/') {
+		pathInfo = req.URL.Path
+		scriptName = ""
+	}
+
+	if endpoint.Config.FCGIIndex != "" {
+		scriptName = path.Join("/", scriptName, endpoint.Config.FCGIIndex)
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "promise",
+		"SERVER_PROTOCOL":   req.Proto,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"SCRIPT_NAME":       scriptName,
+		"PATH_INFO":         pathInfo,
+		"DOCUMENT_ROOT":     endpoint.Config.FCGIDocumentRoot,
+		"SCRIPT_FILENAME":   path.Join(endpoint.Config.FCGIDocumentRoot, scriptName),
+		"SERVER_NAME":       req.Host,
+	}
+
+	if host, port, err := net.SplitHostPort(req.Host); err == nil {
+		params["SERVER_NAME"] = host
+		params["SERVER_PORT"] = port
+	}
+
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		params["REMOTE_ADDR"] = host
+		params["REMOTE_PORT"] = port
+	}
+
+	if req.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+
+	if req.ContentLength >= 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		params["CONTENT_TYPE"] = contentType
+	}
+
+	// Pass the headers along, except for Proxy, which CGI programs would
+	// mistake for the HTTP_PROXY environment variable, and the content
+	// headers, which CONTENT_TYPE and CONTENT_LENGTH already carry.
+	for name, values := range req.Header {
+		name = "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		switch name {
+		case "HTTP_PROXY", "HTTP_CONTENT_TYPE", "HTTP_CONTENT_LENGTH":
+		default:
+			params[name] = strings.Join(values, ", ")
+		}
+	}
+
+	return params
+}
+
+// fcgiTransport is a RoundTripper that sends requests to a FastCGI responder,
+// using one connection per request.
+type fcgiTransport struct {
+	config director.ServiceConfig
+	logger *log.Logger
+}
+
+func (t *fcgiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint, ok := EndpointFromContext(req.Context())
+	if !ok {
+		return nil, noEndpointError
+	}
+
+	dialer := net.Dialer{Timeout: t.config.DialTimeout}
+	conn, err := dialer.DialContext(req.Context(), endpoint.Addr.Network(), endpoint.Addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the connection if the request is canceled.
+	stop := context.AfterFunc(req.Context(), func() { conn.Close() })
+
+	c := &fcgiConn{conn: conn, r: bufio.NewReader(conn)}
+	if err := t.writeParams(c, req, endpoint); err != nil {
+		stop()
+		conn.Close()
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// Send the body while stdout is read, since responders may write output
+	// before reading all of a large body. Once both socket buffers filled,
+	// neither side could make progress otherwise.
+	pr, pw := io.Pipe()
+	go func() {
+		if err := writeBody(c, req); err != nil {
+			pw.CloseWithError(err)
+			conn.Close()
+		}
+	}()
+
+	// Copy stdout into a pipe the CGI response is parsed from.
+	go func() {
+		defer stop()
+		defer conn.Close()
+		for {
+			recType, content, err := c.readRecord()
+			if err != nil {
+
+				// A responder that closes the connection without ending the
+				// request has cut its response short.
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				pw.CloseWithError(err)
+				return
+			}
+
+			switch recType {
+			case fcgiStdout:
+				if _, err := pw.Write(content); err != nil {
+					return
+				}
+			case fcgiStderr:
+				logEntry(t.logger, log.Fields{"service": endpoint.Service}).Warn(strings.TrimSpace(string(content)))
+			case fcgiEndRequest:
+				pw.Close()
+				return
+			}
+		}
+	}()
+
+	br := bufio.NewReader(pr)
+	resp, err := readCGIResponse(br, req)
+	if err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, pr}
+	return resp, nil
+}
+
+// writeParams begins the request and sends its CGI environment.
+func (t *fcgiTransport) writeParams(c *fcgiConn, req *http.Request, endpoint *director.Endpoint) error {
+
+	// Begin a request in the responder role without keeping the connection.
+	if err := c.writeRecord(fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	return c.writeStream(fcgiParams, bytes.NewReader(encodeParams(fcgiParamsFor(req, endpoint))))
+}
+
+// writeBody sends the request body as stdin, closing the body.
+func writeBody(c *fcgiConn, req *http.Request) error {
+	var body io.Reader
+	if req.Body != nil {
+		body = req.Body
+		defer req.Body.Close()
+	}
+
+	return c.writeStream(fcgiStdin, body)
+}
+
+// readCGIResponse parses the headers of a CGI response. The Status header, if
+// present, sets the response status.
+func readCGIResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header(header),
+		Request:    req,
+	}
+
+	if status := header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Status = status
+		resp.StatusCode = code
+		resp.Header.Del("Status")
+	}
+
+	resp.ContentLength = -1
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		if n, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
+			resp.ContentLength = n
+		}
+	}
+
+	return resp, nil
+}
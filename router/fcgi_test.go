@@ -0,0 +1,228 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/newsdev/promise/director"
+)
+
+func TestFCGITransport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Stand in for a FastCGI responder such as PHP-FPM.
+	go fcgi.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		env := fcgi.ProcessEnv(req)
+		w.Header().Set("X-Script-Filename", env["SCRIPT_FILENAME"])
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s", req.Method, req.URL.Path, body)
+	}))
+
+	endpoint := &director.Endpoint{
+		Service: "legacy",
+		Prefix:  "tools",
+		Addr:    listener.Addr(),
+		Config: director.ServiceConfig{
+			Protocol:         director.ProtocolFCGI,
+			FCGIDocumentRoot: "/var/www",
+			FCGIIndex:        "index.php",
+		},
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com/tools/edit", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := newTransportCache(nil, false, nil).RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if filename := resp.Header.Get("X-Script-Filename"); filename != "/var/www/tools/index.php" {
+		t.Errorf("unexpected script filename %q", filename)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "POST /tools/edit body" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestFCGIParams(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com:8080/app/a/b?q=1", nil)
+	req.Header.Set("Proxy", "http://evil")
+
+	params := fcgiParamsFor(req, &director.Endpoint{Prefix: "app/"})
+
+	expected := map[string]string{
+		"SCRIPT_NAME":  "/app",
+		"PATH_INFO":    "/a/b",
+		"QUERY_STRING": "q=1",
+		"SERVER_NAME":  "example.com",
+		"SERVER_PORT":  "8080",
+	}
+
+	for name, value := range expected {
+		if params[name] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, params[name])
+		}
+	}
+
+	if _, ok := params["HTTP_PROXY"]; ok {
+		t.Error("the Proxy header was passed as HTTP_PROXY")
+	}
+}
+
+func TestFCGIParamsContentHeaders(t *testing.T) {
+	req, _ := http.NewRequest("POST", "http://example.com/app/form", strings.NewReader("a=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Length", "3")
+
+	params := fcgiParamsFor(req, &director.Endpoint{Prefix: "app/"})
+
+	if params["CONTENT_TYPE"] != "application/x-www-form-urlencoded" || params["CONTENT_LENGTH"] != "3" {
+		t.Errorf("unexpected content params %q and %q", params["CONTENT_TYPE"], params["CONTENT_LENGTH"])
+	}
+
+	for _, name := range []string{"HTTP_CONTENT_TYPE", "HTTP_CONTENT_LENGTH"} {
+		if _, ok := params[name]; ok {
+			t.Errorf("the content header was passed as %s", name)
+		}
+	}
+}
+
+func TestFCGIParamsSegments(t *testing.T) {
+	for _, test := range []struct {
+		prefix, path, scriptName, pathInfo string
+	}{
+		{"app", "/app", "/app", ""},
+		{"app", "/app/a", "/app", "/a"},
+		{"app", "/application", "", "/application"},
+		{"app/", "/application/a", "", "/application/a"},
+		{"", "/a", "", "/a"},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		params := fcgiParamsFor(req, &director.Endpoint{Prefix: test.prefix})
+
+		if params["SCRIPT_NAME"] != test.scriptName || params["PATH_INFO"] != test.pathInfo {
+			t.Errorf("%s under %q: expected %q and %q, got %q and %q", test.path, test.prefix, test.scriptName, test.pathInfo, params["SCRIPT_NAME"], params["PATH_INFO"])
+		}
+	}
+}
+
+func TestFCGITransportStreaming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A responder that writes a large response before reading a large body
+	// fills both socket buffers unless the body is sent while the response
+	// is read.
+	output := strings.Repeat("o", 4<<20)
+	go fcgi.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, output)
+		body, _ := io.ReadAll(req.Body)
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+
+	endpoint := &director.Endpoint{
+		Service: "legacy",
+		Addr:    listener.Addr(),
+		Config:  director.ServiceConfig{Protocol: director.ProtocolFCGI},
+	}
+
+	req, err := http.NewRequest("POST", "http://example.com/upload", strings.NewReader(strings.Repeat("i", 4<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := newTransportCache(nil, false, nil).RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := output + strconv.Itoa(4<<20); string(body) != expected {
+		t.Errorf("unexpected body of %d bytes", len(body))
+	}
+}
+
+func TestFCGITransportTruncated(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Stand in for a responder that dies partway through its response.
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		c := &fcgiConn{conn: conn, r: bufio.NewReader(conn)}
+		for {
+			recType, content, err := c.readRecord()
+			if err != nil {
+				return
+			}
+			if recType == fcgiStdin && len(content) == 0 {
+				break
+			}
+		}
+
+		c.writeRecord(fcgiStdout, []byte("Content-Type: text/plain\r\n\r\npartial"))
+	}()
+
+	endpoint := &director.Endpoint{
+		Service: "legacy",
+		Addr:    listener.Addr(),
+		Config:  director.ServiceConfig{Protocol: director.ProtocolFCGI},
+	}
+
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := newTransportCache(nil, false, nil).RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
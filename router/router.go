@@ -0,0 +1,167 @@
+// Package router proxies HTTP requests and TCP connections to the upstream
+// addresses picked by a director.
+package router
+
+import (
+	"net/http"
+	"net/http/httputil"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+// ErrorHandler writes the response to a request that couldn't be proxied,
+// either because the director couldn't route it or because the upstream
+// request failed.
+type ErrorHandler func(w http.ResponseWriter, req *http.Request, err error)
+
+// Middleware wraps the handler of a router.
+type Middleware func(http.Handler) http.Handler
+
+// Option configures a router or a TCP proxy. TCP proxies only use the
+// logger.
+type Option func(*options)
+
+// options holds the settings options configure.
+type options struct {
+	transport         http.RoundTripper
+	enableCompression bool
+	errorHandler      ErrorHandler
+	logger            *log.Logger
+	middleware        []Middleware
+}
+
+// logEntry returns an entry of the logger, or of logrus's standard logger
+// without one, with the fields set.
+func logEntry(logger *log.Logger, fields log.Fields) *log.Entry {
+	if logger != nil {
+		return logger.WithFields(fields)
+	}
+	return log.WithFields(fields)
+}
+
+// WithTransport sets the transport upstream requests are sent through. The
+// endpoint of each request is available from EndpointFromContext. By
+// default, each service gets its own transport, configured from the
+// service's settings.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithCompression enables the default transport's transparent compression of
+// upstream responses.
+func WithCompression(enable bool) Option {
+	return func(o *options) {
+		o.enableCompression = enable
+	}
+}
+
+// WithErrorHandler sets the handler of requests that couldn't be proxied. By
+// default, the error is logged and the response is a 502 Bad Gateway.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithLogger sets the logger errors are reported to, instead of logrus's
+// standard logger. This covers failed requests and connections, and the
+// stderr of FastCGI services.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithMiddleware wraps the router's handler in the middleware. The first
+// middleware given is the outermost, and sees every request first.
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
+
+// Router is an http.Handler that proxies each request to an endpoint the
+// director picks by the request's hostname and path.
+type Router struct {
+	options
+	director director.Director
+
+	// handler is the proxy wrapped in the middleware.
+	handler http.Handler
+}
+
+// New returns a router for the director, configured by the options.
+func New(d director.Director, options ...Option) *Router {
+	r := &Router{director: d}
+	for _, option := range options {
+		option(&r.options)
+	}
+
+	if r.transport == nil {
+		r.transport = newTransportCache(d, r.enableCompression, r.logger)
+	}
+
+	if r.errorHandler == nil {
+		r.errorHandler = r.badGateway
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: r.transport,
+		Director: func(req *http.Request) {
+
+			// Set the missing portions of the URL. The endpoint was picked, and
+			// stored in the context, before the request reached the proxy.
+			if endpoint, ok := EndpointFromContext(req.Context()); ok {
+				req.URL.Scheme = endpoint.Config.Scheme()
+				req.URL.Host = upstreamHost(endpoint.Addr)
+			}
+		},
+		ErrorHandler: r.errorHandler,
+	}
+
+	r.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		// Get an endpoint from the director. Requests for hosts we don't know
+		// about are never proxied.
+		endpoint, err := r.director.Pick(req.Host, req.URL.Path)
+		if err != nil {
+			r.errorHandler(w, req, err)
+			return
+		}
+
+		proxy.ServeHTTP(w, req.WithContext(withEndpoint(req.Context(), endpoint)))
+	})
+
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		r.handler = r.middleware[i](r.handler)
+	}
+
+	return r
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(w, req)
+}
+
+// ListenAndServe listens on the TCP address and proxies every request it
+// receives, until the server fails.
+func (r *Router) ListenAndServe(addr string) error {
+	logEntry(r.logger, log.Fields{"addr": addr}).Info("listening")
+	return (&http.Server{Addr: addr, Handler: r}).ListenAndServe()
+}
+
+// badGateway is the default error handler. It logs the error and responds
+// with a 502 Bad Gateway.
+func (r *Router) badGateway(w http.ResponseWriter, req *http.Request, err error) {
+	fields := log.Fields{"host": req.Host, "path": req.URL.Path}
+	if endpoint, ok := EndpointFromContext(req.Context()); ok {
+		fields["service"] = endpoint.Service
+	}
+
+	logEntry(r.logger, fields).Error(err)
+
+	w.WriteHeader(http.StatusBadGateway)
+}
@@ -0,0 +1,156 @@
+package router
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newsdev/promise/director"
+)
+
+// roundTripperFunc adapts a function to an http.RoundTripper.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRouter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Path", req.URL.Path)
+	}))
+	defer backend.Close()
+
+	// Middleware should run in the order given, outermost first.
+	var order []string
+	middleware := func(name string) Middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				h.ServeHTTP(w, req)
+			})
+		}
+	}
+
+	r := New(&serviceDirector{addr: backend.Listener.Addr()}, WithMiddleware(middleware("a"), middleware("b")))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/users", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("X-Path") != "/users" {
+		t.Errorf("unexpected response %d %v", w.Code, w.Header())
+	}
+
+	if strings.Join(order, ",") != "a,b" {
+		t.Errorf("middleware ran in the order %v", order)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	var handled error
+	r := New(director.NewCompositeDirector(), WithErrorHandler(func(w http.ResponseWriter, req *http.Request, err error) {
+		handled = err
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+
+	if handled == nil || w.Code != http.StatusNotFound {
+		t.Errorf("unexpected response %d for error %v", w.Code, handled)
+	}
+
+	// Without an error handler, unroutable requests are a bad gateway.
+	w = httptest.NewRecorder()
+	New(director.NewCompositeDirector()).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+}
+
+func TestRouterTransport(t *testing.T) {
+	d := &serviceDirector{addr: testEndpoint(t, "127.0.0.1:8080", director.ServiceConfig{}).Addr}
+
+	var picked *director.Endpoint
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		picked, _ = EndpointFromContext(req.Context())
+		return &http.Response{StatusCode: http.StatusTeapot, Body: http.NoBody, Request: req}, nil
+	})
+
+	w := httptest.NewRecorder()
+	New(d, WithTransport(transport)).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+
+	if w.Code != http.StatusTeapot || picked == nil || picked.Addr.String() != "127.0.0.1:8080" {
+		t.Errorf("unexpected response %d for endpoint %+v", w.Code, picked)
+	}
+}
+
+// timeoutDirector is a Director that always picks the same address, of a
+// service with a timeout.
+type timeoutDirector struct {
+	serviceDirector
+	timeout time.Duration
+}
+
+func (d *timeoutDirector) Pick(hostname, path string) (*director.Endpoint, error) {
+	endpoint, err := d.serviceDirector.Pick(hostname, path)
+	if err == nil {
+		endpoint.Config = director.ServiceConfig{Protocol: director.ProtocolHTTP, Timeout: d.timeout}
+	}
+	return endpoint, err
+}
+
+func TestRouterUpgrade(t *testing.T) {
+
+	// Stand in for a backend that switches to a line-based echo protocol.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+
+		line, _ := rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}))
+	defer backend.Close()
+
+	// The upgraded connection should outlive the service's timeout.
+	timeout := 50 * time.Millisecond
+	server := httptest.NewServer(New(&timeoutDirector{serviceDirector{addr: backend.Listener.Addr()}, timeout}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	time.Sleep(2 * timeout)
+
+	if _, err := conn.Write([]byte("PING\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "PING\n" {
+		t.Errorf("unexpected reply %q, %v", line, err)
+	}
+}
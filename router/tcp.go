@@ -0,0 +1,99 @@
+package router
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+// TCPProxy forwards raw connections to the addresses of a single service.
+type TCPProxy struct {
+	options
+	director director.Director
+	service  string
+}
+
+// NewTCPProxy returns a proxy forwarding connections to the addresses the
+// director picks for the named service. Only WithLogger applies to TCP
+// proxies; other options are ignored.
+func NewTCPProxy(d director.Director, service string, options ...Option) *TCPProxy {
+	p := &TCPProxy{director: d, service: service}
+	for _, option := range options {
+		option(&p.options)
+	}
+	return p
+}
+
+// ListenAndServe listens on the TCP address and forwards every connection it
+// accepts, until the listener fails.
+func (p *TCPProxy) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	logEntry(p.logger, log.Fields{"addr": addr, "service": p.service}).Info("listening for TCP")
+	return p.Serve(listener)
+}
+
+// Serve accepts connections from the listener until it fails.
+func (p *TCPProxy) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *TCPProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	fields := log.Fields{"service": p.service, "remote": conn.RemoteAddr().String()}
+
+	// Get an endpoint of the service from the director.
+	endpoint, err := p.director.PickService(p.service)
+	if err != nil {
+		logEntry(p.logger, fields).Error(err)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: endpoint.Config.DialTimeout}
+	upstream, err := dialer.Dial(endpoint.Addr.Network(), endpoint.Addr.String())
+	if err != nil {
+		logEntry(p.logger, fields).Error(err)
+		return
+	}
+	defer upstream.Close()
+
+	// Copy in both directions, closing each write side once its source is
+	// exhausted so half-closed connections behave.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(upstream, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(conn, upstream)
+	}()
+	wg.Wait()
+}
+
+func copyAndCloseWrite(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if closer, ok := dst.(interface {
+		CloseWrite() error
+	}); ok {
+		closer.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+// serviceDirector is a Director that always picks the same address.
+type serviceDirector struct {
+	addr net.Addr
+}
+
+func (d *serviceDirector) Pick(hostname, path string) (*director.Endpoint, error) {
+	return d.PickService("")
+}
+
+func (d *serviceDirector) PickService(name string) (*director.Endpoint, error) {
+	return &director.Endpoint{Service: name, Addr: d.addr}, nil
+}
+
+// unknownDirector is a Director that knows of no services.
+type unknownDirector struct{}
+
+func (unknownDirector) Pick(hostname, path string) (*director.Endpoint, error) {
+	return nil, errors.New("no such host")
+}
+
+func (unknownDirector) PickService(name string) (*director.Endpoint, error) {
+	return nil, errors.New("no such service")
+}
+
+// lineWriter sends each write to a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestTCPProxy(t *testing.T) {
+
+	// Stand in for a line-based backend that echoes what it receives.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte(line))
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	proxy := NewTCPProxy(&serviceDirector{addr: backend.Addr()}, "echo")
+	go proxy.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("PING\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "PING\n" {
+		t.Errorf("unexpected reply %q", line)
+	}
+}
+
+func TestTCPProxyLogger(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	lines := make(lineWriter, 1)
+	logger := log.New()
+	logger.Out = lines
+
+	proxy := NewTCPProxy(unknownDirector{}, "echo", WithLogger(logger))
+	go proxy.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if line := <-lines; !strings.Contains(line, "no such service") {
+		t.Errorf("unexpected log line %q", line)
+	}
+}
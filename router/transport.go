@@ -0,0 +1,320 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+var (
+	noEndpointError = errors.New("no endpoint for request")
+	caBundleError   = errors.New("no certificates found in CA bundle")
+	serverNameError = errors.New("TLS over a unix socket needs the tls_server_name setting")
+)
+
+const (
+	unixHostSuffix = ".unix"
+
+	// transportRetryDelay is how long a service whose transport couldn't be
+	// built, such as for a missing CA bundle, waits before it's built again.
+	transportRetryDelay = 5 * time.Second
+
+	// transportPruneInterval is how often transports of services that are
+	// no longer routed to are closed and dropped.
+	transportPruneInterval = time.Minute
+)
+
+type endpointContextKey struct{}
+
+// withEndpoint returns a copy of the request context carrying the endpoint
+// picked for the request.
+func withEndpoint(ctx context.Context, endpoint *director.Endpoint) context.Context {
+	return context.WithValue(ctx, endpointContextKey{}, endpoint)
+}
+
+// EndpointFromContext returns the endpoint stored in the context, if any. A
+// router stores the endpoint it picked in the context of the request it hands
+// to the transport.
+func EndpointFromContext(ctx context.Context) (*director.Endpoint, bool) {
+	endpoint, ok := ctx.Value(endpointContextKey{}).(*director.Endpoint)
+	return endpoint, ok
+}
+
+// upstreamHost returns the URL host for an upstream address. Unix socket
+// paths are hex encoded into a host name that dial decodes, which gives every
+// socket its own connection pool.
+func upstreamHost(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return hex.EncodeToString([]byte(addr.String())) + unixHostSuffix
+	}
+	return addr.String()
+}
+
+// dial connects to an upstream address produced by upstreamHost, giving up
+// after the given timeout.
+func dial(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+
+	if host, _, err := net.SplitHostPort(address); err == nil && strings.HasSuffix(host, unixHostSuffix) {
+		path, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+		if err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, "unix", string(path))
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// readPEM returns the value itself if it holds PEM data, otherwise it treats
+// the value as a path and reads the file.
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+// newTLSConfig builds the client TLS configuration for a service.
+func newTLSConfig(config director.ServiceConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+
+	// Use the given CA bundle instead of the system roots.
+	if config.TLSCA != "" {
+		ca, err := readPEM(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, caBundleError
+		}
+	}
+
+	// Load the client certificate for mutual TLS.
+	if config.TLSCert != "" || config.TLSKey != "" {
+		cert, err := readPEM(config.TLSCert)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := readPEM(config.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		certificate, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// newTransport builds a transport for a service configuration.
+func newTransport(config director.ServiceConfig, enableCompression bool, logger *log.Logger) (http.RoundTripper, error) {
+	if config.Protocol == director.ProtocolFCGI {
+		return &fcgiTransport{config: config, logger: logger}, nil
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dial(ctx, network, address, config.DialTimeout)
+		},
+		DisableCompression:    !enableCompression,
+		Protocols:             new(http.Protocols),
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConns,
+		IdleConnTimeout:       config.IdleTimeout,
+	}
+
+	switch config.Protocol {
+	case director.ProtocolH2:
+		transport.Protocols.SetHTTP2(true)
+	case director.ProtocolH2C:
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		transport.Protocols.SetHTTP1(true)
+	}
+
+	if config.TLS() {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+type serviceTransport struct {
+	config    director.ServiceConfig
+	transport http.RoundTripper
+	err       error
+
+	// built is when the transport was built, or failed to be.
+	built time.Time
+}
+
+// closeIdleConnections lets the transport's pooled connections go.
+func (st *serviceTransport) closeIdleConnections() {
+	if closer, ok := st.transport.(interface {
+		CloseIdleConnections()
+	}); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// transportCache is a RoundTripper that sends each request through a
+// transport configured for the service of the request's endpoint. Transports
+// are rebuilt whenever a service's configuration changes, and dropped once
+// the director no longer defines the service.
+type transportCache struct {
+	services          director.ServiceFinder
+	enableCompression bool
+	logger            *log.Logger
+
+	lock       sync.Mutex
+	transports map[string]*serviceTransport
+	lastPrune  time.Time
+}
+
+// newTransportCache returns a transport cache for the services of the
+// director. Transports are only pruned if the director is a ServiceFinder,
+// since picking an endpoint to check for a service would disturb its
+// round-robin position.
+func newTransportCache(d director.Director, enableCompression bool, logger *log.Logger) *transportCache {
+	services, _ := d.(director.ServiceFinder)
+	return &transportCache{
+		services:          services,
+		enableCompression: enableCompression,
+		logger:            logger,
+		transports:        make(map[string]*serviceTransport),
+		lastPrune:         time.Now(),
+	}
+}
+
+// get returns the transport for the endpoint's service, building a new one if
+// the service is new or its configuration has changed. A transport that
+// failed to build is tried again after transportRetryDelay.
+func (t *transportCache) get(endpoint *director.Endpoint) (http.RoundTripper, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	if t.services != nil && now.Sub(t.lastPrune) >= transportPruneInterval {
+		t.prune(endpoint.Service)
+		t.lastPrune = now
+	}
+
+	if st, ok := t.transports[endpoint.Service]; ok {
+		if st.config == endpoint.Config && (st.err == nil || now.Sub(st.built) < transportRetryDelay) {
+			return st.transport, st.err
+		}
+
+		st.closeIdleConnections()
+	}
+
+	transport, err := newTransport(endpoint.Config, t.enableCompression, t.logger)
+	t.transports[endpoint.Service] = &serviceTransport{
+		config:    endpoint.Config,
+		transport: transport,
+		err:       err,
+		built:     now,
+	}
+
+	return transport, err
+}
+
+// prune closes and drops the transports of services the director no longer
+// defines, other than the one being requested. Such a service gets a new
+// transport if it's routed to again. The caller must hold the lock.
+func (t *transportCache) prune(requested string) {
+	for service, st := range t.transports {
+		if service == requested {
+			continue
+		}
+
+		if !t.services.HasService(service) {
+			st.closeIdleConnections()
+			delete(t.transports, service)
+		}
+	}
+}
+
+func (t *transportCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint, ok := EndpointFromContext(req.Context())
+	if !ok {
+		return nil, noEndpointError
+	}
+
+	// The host of a unix address is its encoded path, which mustn't be sent
+	// as the server name or checked against the certificate.
+	if endpoint.Config.TLS() && endpoint.Config.TLSServerName == "" && endpoint.Addr.Network() == "unix" {
+		return nil, serverNameError
+	}
+
+	transport, err := t.get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Config.Timeout <= 0 {
+		return transport.RoundTrip(req)
+	}
+
+	// Limit the whole exchange. The context has to outlive this call so the
+	// body can be read, so it's canceled when the body is closed instead.
+	ctx, cancel := context.WithTimeout(req.Context(), endpoint.Config.Timeout)
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// A protocol switch hands the connection over as the body, which the
+	// proxy writes to as well, so it must stay an io.ReadWriteCloser. The
+	// transport no longer watches the context of an upgraded connection, so
+	// the timeout only covers the handshake.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		cancel()
+		return resp, nil
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels a request's context once its response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,230 @@
+package router
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/newsdev/promise/director"
+)
+
+func testEndpoint(t *testing.T, address string, config director.ServiceConfig) *director.Endpoint {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &director.Endpoint{Service: "test", Addr: addr, Config: config}
+}
+
+func testRoundTrip(t *testing.T, transport http.RoundTripper, endpoint *director.Endpoint) *http.Response {
+	req, err := http.NewRequest("GET", endpoint.Config.Scheme()+"://"+upstreamHost(endpoint.Addr)+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := transport.RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+func TestTransportCacheH2C(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	endpoint := testEndpoint(t, server.Listener.Addr().String(), director.ServiceConfig{Protocol: director.ProtocolH2C})
+	if resp := testRoundTrip(t, newTransportCache(nil, false, nil), endpoint); resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+}
+
+func TestTransportCacheHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	transports := newTransportCache(nil, false, nil)
+
+	// The test server's certificate isn't trusted without further settings.
+	endpoint := testEndpoint(t, server.Listener.Addr().String(), director.ServiceConfig{Protocol: director.ProtocolHTTPS})
+	req, _ := http.NewRequest("GET", "https://"+upstreamHost(endpoint.Addr)+"/", nil)
+	if _, err := transports.RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint))); err == nil {
+		t.Error("no error reported for an untrusted certificate")
+	}
+
+	// Changing the configuration should rebuild the transport.
+	endpoint.Config.TLSInsecureSkipVerify = true
+	if resp := testRoundTrip(t, transports, endpoint); resp.TLS == nil || resp.ProtoMajor != 1 {
+		t.Errorf("expected HTTP/1.1 over TLS, got %s", resp.Proto)
+	}
+}
+
+func TestTransportCacheUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	endpoint := &director.Endpoint{
+		Service: "test",
+		Addr:    &net.UnixAddr{Name: path, Net: "unix"},
+		Config:  director.ServiceConfig{Protocol: director.ProtocolHTTP},
+	}
+
+	if resp := testRoundTrip(t, newTransportCache(nil, false, nil), endpoint); resp.StatusCode != http.StatusTeapot {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestTransportCacheTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	endpoint := testEndpoint(t, server.Listener.Addr().String(), director.ServiceConfig{
+		Protocol: director.ProtocolHTTP,
+		Timeout:  50 * time.Millisecond,
+	})
+
+	req, _ := http.NewRequest("GET", "http://"+upstreamHost(endpoint.Addr)+"/", nil)
+	if _, err := newTransportCache(nil, false, nil).RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint))); err == nil {
+		t.Error("no error reported for a request exceeding the timeout")
+	}
+}
+
+func TestTransportCacheRetry(t *testing.T) {
+	transports := newTransportCache(nil, false, nil)
+
+	endpoint := testEndpoint(t, "127.0.0.1:443", director.ServiceConfig{
+		Protocol: director.ProtocolHTTPS,
+		TLSCA:    filepath.Join(t.TempDir(), "missing.pem"),
+	})
+
+	_, err := transports.get(endpoint)
+	if err == nil {
+		t.Fatal("no error reported for a missing CA bundle")
+	}
+
+	// The error is kept for a while, rather than reading the file for every
+	// request.
+	if _, retried := transports.get(endpoint); retried != err {
+		t.Errorf("expected the cached error, got %v", retried)
+	}
+
+	transports.transports[endpoint.Service].built = time.Now().Add(-transportRetryDelay)
+	if _, retried := transports.get(endpoint); retried == err || retried == nil {
+		t.Errorf("expected a new error, got %v", retried)
+	}
+}
+
+func TestTransportCachePrune(t *testing.T) {
+	d := director.NewMemoryDirector()
+	for _, addr := range []string{"127.0.0.1:8080", "127.0.0.1:8081"} {
+		if err := d.SetServiceAddr("kept", addr, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.SetServiceAddr("test", "1", "127.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+
+	transports := newTransportCache(d, false, nil)
+	for _, service := range []string{"kept", "removed"} {
+		endpoint := testEndpoint(t, "127.0.0.1:80", director.ServiceConfig{Protocol: director.ProtocolHTTP})
+		endpoint.Service = service
+		if _, err := transports.get(endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Services are only pruned once in a while.
+	requested := testEndpoint(t, "127.0.0.1:80", director.ServiceConfig{Protocol: director.ProtocolHTTP})
+	if _, err := transports.get(requested); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transports.transports["removed"]; !ok {
+		t.Fatal("a service was pruned before the prune interval")
+	}
+
+	before, err := d.PickService("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transports.lastPrune = time.Now().Add(-transportPruneInterval)
+	if _, err := transports.get(requested); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transports.transports["removed"]; ok {
+		t.Error("a service the director no longer has wasn't pruned")
+	}
+	for _, service := range []string{"kept", requested.Service} {
+		if _, ok := transports.transports[service]; !ok {
+			t.Errorf("the %s service was pruned", service)
+		}
+	}
+
+	// Pruning mustn't pick endpoints, which would advance the round-robin
+	// position of the services it checks.
+	if after, err := d.PickService("kept"); err != nil || after.Addr.String() == before.Addr.String() {
+		t.Errorf("unexpected endpoint %+v, %v after %+v", after, err, before)
+	}
+}
+
+func TestTransportCacheUnixTLS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	server.Listener = listener
+	server.StartTLS()
+	defer server.Close()
+
+	endpoint := &director.Endpoint{
+		Service: "test",
+		Addr:    &net.UnixAddr{Name: path, Net: "unix"},
+		Config: director.ServiceConfig{
+			Protocol: director.ProtocolHTTPS,
+			TLSCA:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+		},
+	}
+
+	// Without a server name, the encoded path would be sent as one.
+	transports := newTransportCache(nil, false, nil)
+	req, _ := http.NewRequest("GET", "https://"+upstreamHost(endpoint.Addr)+"/", nil)
+	if _, err := transports.RoundTrip(req.WithContext(withEndpoint(req.Context(), endpoint))); err != serverNameError {
+		t.Errorf("expected %v, got %v", serverNameError, err)
+	}
+
+	// The test server's certificate is valid for example.com.
+	endpoint.Config.TLSServerName = "example.com"
+	if resp := testRoundTrip(t, transports, endpoint); resp.StatusCode != http.StatusTeapot {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
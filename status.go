@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/newsdev/promise/director"
+)
+
+// listenerStatus is the JSON form of a listener's staleness.
+type listenerStatus struct {
+	Listener      string     `json:"listener"`
+	SyncState     string     `json:"sync_state,omitempty"`
+	LastConfirmed *time.Time `json:"last_confirmed,omitempty"`
+	Stale         bool       `json:"stale"`
+}
+
+// statusBoard tracks the director of every listener, reporting how current
+// their routing tables are and which configuration keys they rejected. A
+// table counts as stale once it hasn't been confirmed for longer than the
+// threshold. A threshold of zero disables the check.
+type statusBoard struct {
+	threshold time.Duration
+	header    string
+
+	lock      sync.Mutex
+	directors map[string]director.Director
+	stale     map[string]bool
+}
+
+func newStatusBoard(threshold time.Duration, header string) *statusBoard {
+	return &statusBoard{
+		threshold: threshold,
+		header:    header,
+		directors: make(map[string]director.Director),
+		stale:     make(map[string]bool),
+	}
+}
+
+// add registers the director of a listener.
+func (s *statusBoard) add(listener string, d director.Director) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.directors[listener] = d
+}
+
+// status reports the staleness of a director. Directors that can't report
+// how current they are are never considered stale.
+func (s *statusBoard) status(listener string, d director.Director) *listenerStatus {
+	status := &listenerStatus{Listener: listener}
+
+	reporter, ok := d.(director.SyncReporter)
+	if !ok {
+		return status
+	}
+
+	status.SyncState = reporter.SyncState().String()
+	if confirmed := reporter.LastConfirmed(); !confirmed.IsZero() {
+		status.LastConfirmed = &confirmed
+	}
+
+	if s.threshold > 0 {
+		status.Stale = status.LastConfirmed == nil || time.Since(*status.LastConfirmed) > s.threshold
+	}
+
+	return status
+}
+
+// statuses reports the staleness of every listener, sorted by listener.
+func (s *statusBoard) statuses() []*listenerStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	statuses := make([]*listenerStatus, 0, len(s.directors))
+	for listener, d := range s.directors {
+		statuses = append(statuses, s.status(listener, d))
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Listener < statuses[j].Listener
+	})
+
+	return statuses
+}
+
+// monitor logs whenever a listener becomes stale or recovers. It's meant to
+// run for the life of the process.
+func (s *statusBoard) monitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, status := range s.statuses() {
+			s.lock.Lock()
+			changed := s.stale[status.Listener] != status.Stale
+			s.stale[status.Listener] = status.Stale
+			s.lock.Unlock()
+
+			if !changed {
+				continue
+			}
+
+			fields := log.Fields{"listener": status.Listener, "sync_state": status.SyncState, "threshold": s.threshold}
+			if status.Stale {
+				log.WithFields(fields).Error("routing table is stale")
+			} else {
+				log.WithFields(fields).Info("routing table is current again")
+			}
+		}
+	}
+}
+
+// serveReady reports readiness. It responds with 503 Service Unavailable if
+// any listener is stale, and the status of every listener as JSON.
+func (s *statusBoard) serveReady(w http.ResponseWriter, req *http.Request) {
+	statuses := s.statuses()
+
+	code := http.StatusOK
+	for _, status := range statuses {
+		if status.Stale {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// serveRejected responds with the rejected configuration keys of every
+// listener as JSON.
+func (s *statusBoard) serveRejected(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	rejections := make(map[string][]*director.Rejection)
+	for listener, d := range s.directors {
+		if validator, ok := d.(director.Validator); ok {
+			rejections[listener] = validator.Rejections()
+		}
+	}
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rejections)
+}
+
+// serveTable responds with the effective routing table of every listener as
+// JSON, including the conflicts between layered prefixes.
+func (s *statusBoard) serveTable(w http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	tables := make(map[string]*director.TableView)
+	for listener, d := range s.directors {
+		if inspector, ok := d.(director.Inspector); ok {
+			tables[listener] = inspector.Table()
+		}
+	}
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tables)
+}
+
+// handler wraps a listener's handler, adding the stale header to responses
+// while the listener's routing table is stale.
+func (s *statusBoard) handler(listener string, d director.Director, h http.Handler) http.Handler {
+	if s.header == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if status := s.status(listener, d); status.Stale {
+			value := "unknown"
+			if status.LastConfirmed != nil {
+				value = status.LastConfirmed.UTC().Format(time.RFC3339)
+			}
+			w.Header().Set(s.header, value)
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/newsdev/promise/director"
+)
+
+// syncDirector is a Director that reports a fixed sync state.
+type syncDirector struct {
+	director.Director
+	state     director.SyncState
+	confirmed time.Time
+}
+
+func (d *syncDirector) SyncState() director.SyncState {
+	return d.state
+}
+
+func (d *syncDirector) LastConfirmed() time.Time {
+	return d.confirmed
+}
+
+func TestStaleness(t *testing.T) {
+	s := newStatusBoard(time.Minute, "X-Promise-Stale")
+	s.add("current", &syncDirector{state: director.SyncCurrent, confirmed: time.Now()})
+
+	stale := &syncDirector{state: director.SyncBackoff, confirmed: time.Now().Add(-time.Hour)}
+	s.add("stale", stale)
+
+	w := httptest.NewRecorder()
+	s.serveReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.handler("stale", stale, http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("X-Promise-Stale") == "" {
+		t.Error("stale header was not set")
+	}
+
+	stale.confirmed = time.Now()
+
+	w = httptest.NewRecorder()
+	s.serveReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+// validDirector is a Director that reports a fixed set of rejected keys.
+type validDirector struct {
+	director.Director
+	rejections []*director.Rejection
+}
+
+func (d *validDirector) Rejections() []*director.Rejection {
+	return d.rejections
+}
+
+func TestStatusBoardRejected(t *testing.T) {
+	s := newStatusBoard(0, "")
+	s.add("promise:80", &validDirector{rejections: []*director.Rejection{
+		{Key: "/promise/services/web/1", Value: "nowhere", Reason: "missing port in address"},
+	}})
+
+	w := httptest.NewRecorder()
+	s.serveRejected(w, httptest.NewRequest("GET", "/rejected", nil))
+
+	var rejections map[string][]*director.Rejection
+	if err := json.NewDecoder(w.Body).Decode(&rejections); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(rejections["promise:80"]); n != 1 {
+		t.Errorf("expected 1 rejection, got %d", n)
+	}
+}
+
+func TestStatusBoardTable(t *testing.T) {
+	shared := director.NewEtcdDirector("promise/shared", []string{})
+	team := director.NewEtcdDirector("promise/team", []string{})
+
+	s := newStatusBoard(0, "")
+	s.add("promise/shared+promise/team:80", director.NewCompositeDirector(shared, team))
+	s.add("other:81", director.NewStaticDirector(nil))
+
+	w := httptest.NewRecorder()
+	s.serveTable(w, httptest.NewRequest("GET", "/table", nil))
+
+	var tables map[string]*director.TableView
+	if err := json.NewDecoder(w.Body).Decode(&tables); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := tables["promise/shared+promise/team:80"]; !ok || len(tables) != 1 {
+		t.Errorf("unexpected tables %v", tables)
+	}
+}